@@ -2,198 +2,307 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"code.google.com/p/go.net/websocket"
 	"code.google.com/p/whispering-gophers/util"
+	"code.google.com/p/whispering-gophers/whisper"
 )
 
 var (
 	httpAddr = flag.String("http", "localhost:8080", "HTTP server address")
 	peerAddr = flag.String("peer", "", "peer host:port")
 	dedup    = flag.Bool("dedup", true, "de-duplicate messages")
+	seenCap  = flag.Int("seen-cap", whisper.DefaultSeenCapacity, "number of message IDs to remember for de-duplication")
+	seenTTL  = flag.Duration("seen-ttl", whisper.DefaultSeenTTL, "how long to remember message IDs for de-duplication")
+	queueLen = flag.Int("queue", whisper.DefaultQueueSize, "outgoing message queue size per peer")
+	ttl      = flag.Int("ttl", 0, "hop limit for messages sent by this node (0 means unlimited)")
+	maxTTL   = flag.Int("max-ttl", 0, "cap on the hop limit of relayed messages (0 means no cap)")
+	minPeers = flag.Int("min-peers", whisper.DefaultMinPeers, "number of peer connections to maintain through peer exchange")
+	maxPeers = flag.Int("max-peers", 0, "stop dialling newly discovered peers beyond this many connections (0 means no limit)")
+	keyFile  = flag.String("key", "whisper.key", "file holding this node's signing key (created if missing)")
+	trusted  = flag.String("trusted", "", "file of public keys; if set, only messages signed by these keys are accepted")
+	sigReq   = flag.Bool("require-sig", false, "drop unsigned messages")
+	useTLS   = flag.Bool("tls", false, "use TLS for peer connections")
+	tlsDir   = flag.String("tls-dir", "whisper-tls", "directory holding this node's TLS certificate (created if missing, unless -tls-ca is set)")
+	tlsCA    = flag.String("tls-ca", "", "directory of trusted CA certificates; if set, peers must present a certificate issued by one of them")
+	entropy  = flag.Duration("anti-entropy", whisper.DefaultAntiEntropyInterval, "how often to offer peers a digest of recent messages (negative disables)")
+	orderWin = flag.Duration("order-window", whisper.DefaultOrderWindow, "how long to hold received messages to display them in causal order")
+	report   = flag.Duration("report", whisper.DefaultReportInterval, "how often to report this node's connections to the mesh (negative disables)")
+	trace    = flag.Bool("trace", false, "log all traffic on peer connections")
+	histFile = flag.String("history", "", "file in which to log messages and from which to answer peers' history requests")
+	syncLast = flag.Int("sync-last", 0, "on connecting, ask peers for this many past messages")
+	syncAge  = flag.Duration("sync-since", 0, "on connecting, ask peers for the messages of this long ago onwards")
+	overflow = whisper.DropOldest
+	logLevel slog.Level
 	self     string
-)
+	node     *whisper.Node
 
-type Message struct {
-	ID   string
-	Addr string
-	Body string
-}
+	// out shows received messages and the log on standard output and
+	// the web page.
+	out io.Writer = os.Stdout
+)
 
 func main() {
+	flag.Var(&overflow, "overflow", "what to do when a peer's queue is full: drop-oldest, drop-newest, block or disconnect")
+	flag.TextVar(&logLevel, "log-level", slog.LevelInfo, "minimum level of log messages: debug, info, warn or error")
 	flag.Parse()
+	out = io.MultiWriter(os.Stdout, logger.Writer())
+	slog.SetDefault(slog.New(slog.NewTextHandler(out, &slog.HandlerOptions{Level: logLevel})))
 
-	l, err := util.Listen()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	var l net.Listener
+	var tlsConfig *tls.Config
+	if *useTLS {
+		tlsConfig, err = util.TLSConfig(*tlsDir, *tlsCA)
+		if err != nil {
+			fatal(err)
+		}
+		l, err = util.ListenTLS(tlsConfig)
+	} else {
+		l, err = util.Listen()
+	}
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
-	self = l.Addr().String()
-	log.Println("Listening on", self)
-
-	if *peerAddr != "" {
-		go dial(*peerAddr)
+	node = whisper.NewNode(l)
+	if tlsConfig != nil {
+		node.Dial = func(ctx context.Context, addr string) (net.Conn, error) {
+			return util.DialTLS(ctx, addr, tlsConfig)
+		}
+	}
+	node.DisableDedup = !*dedup
+	node.SeenIDs = whisper.NewSeenCache(*seenCap, *seenTTL)
+	node.QueueSize = *queueLen
+	node.Overflow = overflow
+	node.TTL = *ttl
+	node.MaxTTL = *maxTTL
+	node.MinPeers = *minPeers
+	node.MaxPeers = *maxPeers
+	node.AntiEntropyInterval = *entropy
+	node.Trace = *trace
+	node.ReportInterval = *report
+	node.RequireSignatures = *sigReq
+	node.Identity, err = whisper.LoadIdentity(*keyFile)
+	if err != nil {
+		fatal(err)
+	}
+	if *trusted != "" {
+		node.TrustedKeys, err = whisper.LoadKeys(*trusted)
+		if err != nil {
+			fatal(err)
+		}
+	}
+	if *histFile != "" {
+		node.History, err = whisper.OpenHistory(*histFile)
+		if err != nil {
+			fatal(err)
+		}
+		defer node.History.Close()
 	}
-	go readInput()
+	if *syncLast > 0 || *syncAge > 0 {
+		req := &whisper.HistoryRequest{Last: *syncLast}
+		if *syncAge > 0 {
+			req.Since = time.Now().Add(-*syncAge)
+		}
+		node.SyncHistory = req
+	}
+	self = node.Addr()
+	slog.Info("listening", "addr", self)
+	slog.Info("identity", "key", node.Identity)
 
+	ch, _ := node.Subscribe()
 	go func() {
-		for {
-			c, err := l.Accept()
-			if err != nil {
-				log.Fatal(err)
-			}
-			go serve(c)
+		for m := range whisper.Ordered(ch, *orderWin) {
+			last.Lock()
+			last.m = m
+			last.Unlock()
+			display(m)
+		}
+	}()
+	node.Start(ctx, *peerAddr)
+	go func() {
+		if err := readInput(ctx); err != nil {
+			slog.Error("reading input", "err", err)
 		}
+		stop()
 	}()
 
 	http.HandleFunc("/", rootHandler)
 	http.Handle("/log", websocket.Handler(logHandler))
-	err = http.ListenAndServe(*httpAddr, nil)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-var peers = &Peers{m: make(map[string]chan<- Message)}
-
-type Peers struct {
-	m  map[string]chan<- Message
-	mu sync.RWMutex
-}
+	http.Handle("/metrics", node.MetricsHandler())
+	http.HandleFunc("/topology", topologyHandler)
+	http.HandleFunc("/send", sendHandler)
+	srv := &http.Server{Addr: *httpAddr}
+	go func() {
+		err := srv.ListenAndServe()
+		if err != http.ErrServerClosed {
+			fatal(err)
+		}
+	}()
 
-func (p *Peers) Add(addr string) <-chan Message {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	if _, ok := p.m[addr]; ok {
-		return nil
+	<-ctx.Done()
+	slog.Info("shutting down")
+	sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(sctx); err != nil {
+		slog.Error("stopping HTTP server", "err", err)
+	}
+	if err := node.Close(); err != nil {
+		slog.Error("closing node", "err", err)
 	}
-	ch := make(chan Message)
-	p.m[addr] = ch
-	return ch
 }
 
-func (p *Peers) Remove(addr string) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	delete(p.m, addr)
+// display shows a received message.
+func display(m whisper.Message) {
+	var prefix string
+	if m.ReplyTo != "" {
+		prefix = "↳ "
+	}
+	switch {
+	case m.To != "":
+		fmt.Fprintf(out, "%v[private from %v] %v\n", prefix, m.Addr, m.Body)
+	case m.Channel != "":
+		fmt.Fprintf(out, "%v[#%v] %v\n", prefix, m.Channel, m.Body)
+	default:
+		fmt.Fprintf(out, "%v%v\n", prefix, m.Body)
+	}
 }
 
-func (p *Peers) List() []chan<- Message {
-	p.mu.RLock()
-	defer p.mu.RUnlock()
-	l := make([]chan<- Message, 0, len(p.m))
-	for _, ch := range p.m {
-		l = append(l, ch)
-	}
-	return l
+func fatal(err error) {
+	slog.Error("fatal", "err", err)
+	os.Exit(1)
 }
 
-func broadcast(m Message) {
-	for _, ch := range peers.List() {
+// readInput sends each line read from standard input as a message until
+// ctx is cancelled or the input ends.
+// A line of the form "/ttl N text" sends text with a hop limit of N.
+func readInput(ctx context.Context) error {
+	lines := make(chan string)
+	errc := make(chan error, 1)
+	go func() {
+		r := bufio.NewReader(os.Stdin)
+		for {
+			s, err := r.ReadString('\n')
+			if err != nil {
+				errc <- err
+				return
+			}
+			select {
+			case lines <- s[:len(s)-1]:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for {
 		select {
-		case ch <- m:
-		default:
-			// Okay to drop messages sometimes.
+		case s := <-lines:
+			send(s)
+		case err := <-errc:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case <-ctx.Done():
+			return nil
 		}
 	}
 }
 
-func serve(c net.Conn) {
-	log.Println("<", c.RemoteAddr(), "accepted connection")
-	d := json.NewDecoder(c)
-	for {
-		var m Message
-		err := d.Decode(&m)
-		if err != nil {
-			log.Println("<", c.RemoteAddr(), "error:", err)
-			break
-		}
-		if Seen(m.ID) {
-			continue
-		}
-		log.Printf("< %v received: %v", c.RemoteAddr(), m)
-		fmt.Println(m.Body)
-		broadcast(m)
-		go dial(m.Addr)
-	}
-	c.Close()
-	log.Println("<", c.RemoteAddr(), "close")
+// channel is the channel that lines of input are sent to,
+// set by the /join and /part commands.
+var channel string
+
+// sendMu serializes lines of input from standard input and the web page.
+var sendMu sync.Mutex
+
+// last is the message most recently displayed, answered by /reply.
+var last struct {
+	sync.Mutex
+	m whisper.Message
 }
 
-func readInput() {
-	r := bufio.NewReader(os.Stdin)
-	for {
-		s, err := r.ReadString('\n')
-		if err != nil {
-			log.Fatal(err)
+// send sends a line of input as a message.
+// A line of the form "/msg ADDR text" sends text privately to the node at
+// ADDR. "/join NAME" joins a channel and sends subsequent lines to it;
+// "/part NAME" leaves it. "/reply text" answers the last message shown.
+func send(s string) {
+	sendMu.Lock()
+	defer sendMu.Unlock()
+	if f := strings.Fields(s); len(f) > 0 && (f[0] == "/join" || f[0] == "/part") {
+		if len(f) != 2 {
+			slog.Warn("usage", "cmd", f[0], "arg", "NAME")
+			return
 		}
-		m := Message{
-			ID:   util.RandomID(),
-			Addr: self,
-			Body: s[:len(s)-1],
+		name := strings.TrimPrefix(f[1], "#")
+		if f[0] == "/join" {
+			node.Join(name)
+			channel = name
+		} else {
+			node.Part(name)
+			if channel == name {
+				channel = ""
+			}
 		}
-		Seen(m.ID)
-		broadcast(m)
-	}
-}
-
-func dial(addr string) {
-	if addr == self {
-		return // Don't try to dial self.
+		slog.Info("joined channels", "channels", node.Channels())
+		return
 	}
-
-	ch := peers.Add(addr)
-	if ch == nil {
-		return // Peer already connected.
+	if strings.HasPrefix(s, "/msg ") {
+		if err := sendDirect(s); err != nil {
+			slog.Warn("sending direct message", "err", err)
+		}
+		return
 	}
-	defer peers.Remove(addr)
-
-	log.Println(">", addr, "dialling")
-	c, err := net.Dial("tcp", addr)
-	if err != nil {
-		log.Println(">", addr, "dial error:", err)
+	if strings.HasPrefix(s, "/reply ") {
+		last.Lock()
+		m := last.m
+		last.Unlock()
+		if m.ID == "" {
+			slog.Warn("no message to reply to")
+			return
+		}
+		if _, err := node.Reply(m, strings.TrimPrefix(s, "/reply ")); err != nil {
+			slog.Warn("sending reply", "err", err)
+		}
 		return
 	}
-	log.Println(">", addr, "connected")
-	defer func() {
-		c.Close()
-		log.Println(">", addr, "closed")
-	}()
-
-	e := json.NewEncoder(c)
-	for m := range ch {
-		err := e.Encode(m)
-		if err != nil {
-			log.Println(">", addr, "error:", err)
+	if strings.HasPrefix(s, "/ttl ") {
+		f := strings.SplitN(s, " ", 3)
+		n, err := strconv.Atoi(f[1])
+		if err != nil || n < 0 || len(f) < 3 {
+			slog.Warn("usage", "cmd", "/ttl", "arg", "N text")
 			return
 		}
+		node.SendTTL(f[2], n)
+		return
 	}
-}
-
-var seenIDs = struct {
-	m map[string]bool
-	sync.Mutex
-}{m: make(map[string]bool)}
-
-func Seen(id string) bool {
-	if !*dedup || id == "" {
-		return false
+	if channel != "" {
+		node.SendChannel(channel, s)
+		return
 	}
-	seenIDs.Lock()
-	ok := seenIDs.m[id]
-	seenIDs.m[id] = true
-	seenIDs.Unlock()
-	return ok
+	node.Send(s)
 }
 
 func rootHandler(w http.ResponseWriter, r *http.Request) {
@@ -211,7 +320,65 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	err := rootTemplate.Execute(w, data)
 	if err != nil {
-		log.Println(err)
+		slog.Error("rendering page", "err", err)
+	}
+}
+
+// sendDirect sends a line of the form "/msg ADDR text".
+func sendDirect(s string) error {
+	f := strings.SplitN(s, " ", 3)
+	if len(f) < 3 || f[0] != "/msg" {
+		return errors.New("usage: /msg ADDR text")
+	}
+	if _, err := node.SendDirect(f[1], f[2]); err != nil {
+		return fmt.Errorf("/msg %v: %v", f[1], err)
+	}
+	return nil
+}
+
+// sendHandler sends a line of input posted from the web page, as the form
+// values "body" and, optionally, "nick". Unless it is a command, the line
+// is sent as "nick: body" and shown on the page. Posts from other pages
+// than the node's own are refused.
+func sendHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin request refused", http.StatusForbidden)
+		return
+	}
+	body := strings.TrimSpace(r.FormValue("body"))
+	if body == "" {
+		http.Error(w, "empty message", http.StatusBadRequest)
+		return
+	}
+	if nick := strings.TrimSpace(r.FormValue("nick")); nick != "" && !strings.HasPrefix(body, "/") {
+		body = nick + ": " + body
+	}
+	send(body)
+	if !strings.HasPrefix(body, "/") {
+		fmt.Fprintln(out, body)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sameOrigin reports whether r was sent by a page served at *httpAddr,
+// where the page's websocket expects to find the server, according to the
+// Origin header browsers add to every POST. Otherwise any web site open in
+// the browser could post a form that sends from the node.
+func sameOrigin(r *http.Request) bool {
+	u, err := url.Parse(r.Header.Get("Origin"))
+	return err == nil && u.Host == *httpAddr
+}
+
+// topologyHandler serves the mesh topology known to the node as JSON.
+func topologyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(node.Topology()); err != nil {
+		slog.Error("writing topology", "err", err)
 	}
 }
 
@@ -219,7 +386,7 @@ var rootTemplate = template.Must(template.New("root").Parse(`
 <!DOCTYPE html>
 <html><head>
 	<script>
-var log, websocket;
+var log, websocket, graph;
 
 function onMessage(e) {
 	log.innerText += e.data;
@@ -228,9 +395,98 @@ function onMessage(e) {
 
 function init() {
 	log = document.getElementById("log");
+	graph = document.getElementById("graph");
 	websocket = new WebSocket("ws://{{.Addr}}/log");
 	websocket.onmessage = onMessage;
 	websocket.onclose = console.log;
+	refresh();
+	setInterval(refresh, 2000);
+
+	var nick = document.getElementById("nick");
+	nick.value = localStorage.getItem("nick") || "";
+	document.getElementById("input").addEventListener("submit", function(e) {
+		e.preventDefault();
+		var body = document.getElementById("body");
+		localStorage.setItem("nick", nick.value);
+		fetch("/send", {
+			method: "POST",
+			body: new URLSearchParams({nick: nick.value, body: body.value})
+		}).then(function(r) {
+			if (r.ok) {
+				body.value = "";
+			} else {
+				r.text().then(console.log);
+			}
+		}, console.log);
+	});
+}
+
+function refresh() {
+	fetch("/topology").then(r => r.json()).then(draw, console.log);
+}
+
+var svgNS = "http://www.w3.org/2000/svg";
+
+function el(name, attrs, text) {
+	var e = document.createElementNS(svgNS, name);
+	for (var k in attrs) {
+		e.setAttribute(k, attrs[k]);
+	}
+	if (text !== undefined) {
+		e.textContent = text;
+	}
+	graph.appendChild(e);
+	return e;
+}
+
+// draw lays the nodes out on a circle, with an arrow from the dialling
+// node to the accepting node of each connection.
+function draw(reports) {
+	var w = graph.clientWidth, h = graph.clientHeight;
+	var r = Math.min(w, h) / 2 - 60;
+	var pos = {}, live = {};
+	var addrs = reports.map(n => n.Addr);
+	reports.forEach(function(n) {
+		live[n.Addr] = n.Live;
+		(n.Peers || []).forEach(function(e) {
+			if (addrs.indexOf(e.Addr) < 0) {
+				addrs.push(e.Addr);
+			}
+		});
+	});
+	addrs.sort();
+	addrs.forEach(function(a, i) {
+		var t = 2 * Math.PI * i / addrs.length;
+		pos[a] = {x: w/2 + r * Math.cos(t), y: h/2 + r * Math.sin(t)};
+	});
+
+	while (graph.lastChild) {
+		graph.removeChild(graph.lastChild);
+	}
+	var defs = el("defs", {});
+	var marker = document.createElementNS(svgNS, "marker");
+	[["id", "arrow"], ["viewBox", "0 0 10 10"], ["refX", "22"], ["refY", "5"],
+	 ["markerWidth", "8"], ["markerHeight", "8"], ["orient", "auto"]].forEach(a => marker.setAttribute(a[0], a[1]));
+	var path = document.createElementNS(svgNS, "path");
+	path.setAttribute("d", "M 0 0 L 10 5 L 0 10 z");
+	marker.appendChild(path);
+	defs.appendChild(marker);
+
+	reports.forEach(function(n) {
+		(n.Peers || []).forEach(function(e) {
+			if (e.Inbound) {
+				return; // Drawn from the dialling side.
+			}
+			var a = pos[n.Addr], b = pos[e.Addr];
+			el("line", {x1: a.x, y1: a.y, x2: b.x, y2: b.y, "class": "edge", "marker-end": "url(#arrow)"});
+			el("text", {x: (a.x+b.x)/2, y: (a.y+b.y)/2, "class": "count"}, e.Sent + " / " + e.Received);
+		});
+	});
+	addrs.forEach(function(a) {
+		var p = pos[a];
+		el("circle", {cx: p.x, cy: p.y, r: 12, "class": live[a] ? "live" : "down"});
+		el("text", {x: p.x, y: p.y - 18, "class": "addr"}, a == "{{.Self}}" ? a + " (self)" : a);
+	});
 }
 
 window.addEventListener("load", init, false);
@@ -239,7 +495,7 @@ window.addEventListener("load", init, false);
 body {
 	font-family: sans-serif;
 }
-#self, #log {
+#self, #log, #graph, #input {
 	position: absolute;
 }
 #self {
@@ -249,14 +505,49 @@ body {
 }
 #log {
 	top: 15%;
-	height: 80%;
+	width: 45%;
+	height: 72%;
 	font-size: 20px;
 	overflow: auto;
+}
+#input {
+	top: 89%;
+	width: 45%;
+}
+#nick {
+	width: 20%;
+}
+#body {
+	width: 70%;
+}
+#graph {
+	top: 15%;
+	left: 50%;
+	width: 48%;
+	height: 80%;
+}
+.edge {
+	stroke: #888;
+}
+.count, .addr {
+	font-size: 12px;
+	text-anchor: middle;
+}
+.live {
+	fill: #4a4;
+}
+.down {
+	fill: #bbb;
 }
 	</style>
 </head><body>
 	<div id="self">{{.Self}}</div>
 	<div id="log"></div>
+	<form id="input">
+		<input id="nick" placeholder="nickname">
+		<input id="body" placeholder="message or /command" autocomplete="off">
+	</form>
+	<svg id="graph"></svg>
 </body>
 </html>
 `))
@@ -268,11 +559,6 @@ type Logger struct {
 
 var logger = &Logger{m: make(map[string]chan<- []byte)}
 
-func init() {
-	log.SetFlags(0)
-	log.SetOutput(io.MultiWriter(os.Stdout, logger.Writer()))
-}
-
 func (l *Logger) Writer() io.Writer {
 	r, w := io.Pipe()
 	go func() {
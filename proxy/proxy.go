@@ -4,110 +4,326 @@
 // Addresses obtained through this package should be treated as opaque strings,
 // even though they look like regular IP addresses.
 //
-// The package registers a "-proxy" command-line flag that specifies the
-// address of the proxy service.
+// A Dialer or ListenConfig names the proxy service to use. The package-level
+// Dial and Listen functions use the service at DefaultProxyAddr, to which a
+// command may bind a flag:
+//
+//	flag.StringVar(&proxy.DefaultProxyAddr, "proxy", proxy.DefaultProxyAddr, "remote proxy address")
 package proxy
 
 import (
-	"flag"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
+	"strings"
+	"time"
 )
 
-var proxyAddr = flag.String("proxy", "localhost:2000", "remote proxy address")
+// DefaultProxyAddr is the address of the proxy service used by Dialers and
+// ListenConfigs that don't name one, including those behind the
+// package-level functions.
+var DefaultProxyAddr = "localhost:2000"
+
+// Errors reported by the proxy service.
+var (
+	ErrUnknownAddress  = errors.New("proxy: no listener at address")
+	ErrUnknownKey      = errors.New("proxy: listener closed")
+	ErrDuplicateAccept = errors.New("proxy: superseded by another Accept")
+	ErrAcceptTimeout   = errors.New("proxy: connection not accepted in time")
+	ErrUnreachable     = errors.New("proxy: address unreachable across partition")
+)
+
+// codeErrors maps the service's error codes to errors.
+var codeErrors = map[string]error{
+	"unknown-address":  ErrUnknownAddress,
+	"unknown-key":      ErrUnknownKey,
+	"duplicate-accept": ErrDuplicateAccept,
+	"timeout":          ErrAcceptTimeout,
+	"unreachable":      ErrUnreachable,
+}
+
+// A Dialer contains options for connecting to an address through a proxy
+// service. The zero value uses DefaultProxyAddr with no timeout.
+type Dialer struct {
+	// ProxyAddr is the address of the proxy service.
+	// If empty, DefaultProxyAddr is used.
+	ProxyAddr string
+
+	// Timeout bounds the time taken to connect to the proxy and get its
+	// answer. Zero means no timeout.
+	Timeout time.Duration
+
+	// Logger, if set, is used to log all traffic with the proxy service;
+	// for debugging proxy/server.
+	Logger *slog.Logger
+
+	// LocalAddr, if set, is the dialer's own address on the proxy service,
+	// such as that of its Listener. The service uses it to decide whether
+	// a partition separates the dialer from the address it dials, and
+	// gives it to the accepting side as the connection's RemoteAddr.
+	// While the service is partitioned, dials without it are refused.
+	// The Dialer method of a Listener returns a Dialer with it set.
+	LocalAddr net.Addr
+}
+
+// A ListenConfig contains options for listening on an address of a proxy
+// service. The zero value uses DefaultProxyAddr with no timeout.
+// Listeners keep the configuration that created them.
+type ListenConfig struct {
+	// ProxyAddr, Timeout and Logger are as for Dialer. Timeout applies to
+	// each request a Listener makes, except the wait for a connection in
+	// Accept.
+	ProxyAddr string
+	Timeout   time.Duration
+	Logger    *slog.Logger
+}
+
+var (
+	defaultDialer       Dialer
+	defaultListenConfig ListenConfig
+)
 
 // Dial opens a connection to the specified address.
+// It gives no address of its own, so while the proxy service is
+// partitioned it can reach nothing; use the Dialer of a Listener instead.
 func Dial(address string) (net.Conn, error) {
-	c, err := net.Dial("tcp", *proxyAddr)
+	return defaultDialer.Dial(address)
+}
+
+// Listen opens a listening socket.
+// Use the Addr method of the returned Listener to obtain the listen address.
+// The Listener is a *Listener.
+func Listen() (net.Listener, error) {
+	return defaultListenConfig.Listen()
+}
+
+// Dial opens a connection to the specified address.
+func (d *Dialer) Dial(address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), address)
+}
+
+// DialContext is like Dial, but gives up when ctx is done. The proxy
+// service answers only once the connection is accepted, so this also
+// bounds the wait for the listener to accept it.
+func (d *Dialer) DialContext(ctx context.Context, address string) (net.Conn, error) {
+	c, err := connect(ctx, d.ProxyAddr, d.Timeout, d.Logger, "dial")
 	if err != nil {
-		return nil, fmt.Errorf("connecting to proxy: %v", err)
+		return nil, err
 	}
-	c = logConn{"dial", c}
-	_, err = fmt.Fprintf(c, "DIAL %v\n", address)
-	if err != nil {
-		c.Close()
-		return nil, fmt.Errorf("connecting to proxy: %v", err)
+	if d.LocalAddr != nil {
+		_, err = fmt.Fprintf(c, "DIAL %v %v\n", address, d.LocalAddr)
+	} else {
+		_, err = fmt.Fprintf(c, "DIAL %v\n", address)
 	}
-	var status string
-	_, err = fmt.Fscan(c, &status)
 	if err != nil {
-		c.Close()
-		return nil, fmt.Errorf("bad response from proxy: %v", err)
+		return nil, c.fail(fmt.Errorf("connecting to proxy: %v", err))
 	}
-	if status != "OK" {
-		c.Close()
-		return nil, fmt.Errorf("bad response from proxy: %v", status)
+	if _, err := readResponse(c, 0); err != nil {
+		return nil, c.fail(err)
 	}
-	return &conn{Conn: c, remote: addr(address)}, nil
+	if err := c.done(); err != nil {
+		return nil, err
+	}
+	pc := &conn{Conn: c, remote: addr(address)}
+	if d.LocalAddr != nil {
+		pc.local = addr(d.LocalAddr.String())
+	}
+	return pc, nil
 }
 
 // Listen opens a listening socket.
 // Use the Addr method of the returned Listener to obtain the listen address.
-func Listen() (net.Listener, error) {
-	c, err := net.Dial("tcp", *proxyAddr)
+// The Listener is a *Listener.
+func (lc *ListenConfig) Listen() (net.Listener, error) {
+	return lc.ListenContext(context.Background())
+}
+
+// ListenContext is like Listen, but gives up when ctx is done.
+func (lc *ListenConfig) ListenContext(ctx context.Context) (net.Listener, error) {
+	c, err := connect(ctx, lc.ProxyAddr, lc.Timeout, lc.Logger, "list")
 	if err != nil {
-		return nil, fmt.Errorf("connecting to proxy: %v", err)
+		return nil, err
 	}
-	c = logConn{"list", c}
 	defer c.Close()
-	_, err = fmt.Fprintln(c, "LISTEN nop")
+	_, err = fmt.Fprintln(c, "LISTEN")
 	if err != nil {
-		return nil, fmt.Errorf("connecting to proxy: %v", err)
+		return nil, c.fail(fmt.Errorf("connecting to proxy: %v", err))
 	}
-	l := &listener{}
-	_, err = fmt.Fscan(c, &l.addr, &l.key)
+	args, err := readResponse(c, 2)
 	if err != nil {
-		return nil, fmt.Errorf("bad response from proxy: %v", err)
+		return nil, c.fail(err)
+	}
+	if err := c.done(); err != nil {
+		return nil, err
 	}
-	return l, nil
+	return &Listener{config: *lc, addr: addr(args[0]), key: args[1]}, nil
 }
 
-type listener struct {
-	key  string
-	addr addr
+// maxResponse is the longest response line accepted from the service.
+const maxResponse = 256
+
+// readResponse reads the service's answer to a request: either "OK"
+// followed by n arguments, which it returns, or "ERROR" and a code, which
+// it returns as an error. The line is read a byte at a time so as not to
+// consume any of the proxied stream that follows it.
+func readResponse(c net.Conn, n int) ([]string, error) {
+	var b []byte
+	buf := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return nil, fmt.Errorf("bad response from proxy: %v", err)
+		}
+		if buf[0] == '\n' {
+			break
+		}
+		if len(b) == maxResponse {
+			return nil, errors.New("bad response from proxy: line too long")
+		}
+		b = append(b, buf[0])
+	}
+	f := strings.Fields(string(b))
+	switch {
+	case len(f) == n+1 && f[0] == "OK":
+		return f[1:], nil
+	case len(f) == 2 && f[0] == "ERROR":
+		if err, ok := codeErrors[f[1]]; ok {
+			return nil, err
+		}
+		return nil, fmt.Errorf("proxy: %v", f[1])
+	}
+	return nil, fmt.Errorf("bad response from proxy: %q", b)
 }
 
-var _ net.Listener = &listener{}
+// proxyConn is a connection to the proxy service on which a request is in
+// progress.
+type proxyConn struct {
+	net.Conn
+	ctx  context.Context
+	stop func() bool // stops ctx from interrupting the connection
+}
 
-func (l *listener) Accept() (c net.Conn, err error) {
-	c, err = net.Dial("tcp", *proxyAddr)
+// connect opens a connection to the proxy service at proxyAddr, or
+// DefaultProxyAddr if it is empty, for a request that must be answered
+// before ctx is done and, if timeout is positive, within timeout.
+func connect(ctx context.Context, proxyAddr string, timeout time.Duration, log *slog.Logger, op string) (*proxyConn, error) {
+	if proxyAddr == "" {
+		proxyAddr = DefaultProxyAddr
+	}
+	d := net.Dialer{Timeout: timeout}
+	c, err := d.DialContext(ctx, "tcp", proxyAddr)
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, fmt.Errorf("connecting to proxy: %v", err)
 	}
-	c = logConn{"acpt", c}
+	if timeout > 0 {
+		c.SetDeadline(time.Now().Add(timeout))
+	}
+	if log != nil {
+		c = logConn{op, c, log}
+	}
+	pc := &proxyConn{Conn: c, ctx: ctx}
+	// Interrupt reads and writes if ctx is done before the request is.
+	pc.stop = context.AfterFunc(ctx, func() {
+		c.SetDeadline(time.Unix(1, 0))
+	})
+	return pc, nil
+}
+
+// fail closes c after the request failed with err, and returns err or,
+// if the request was interrupted by its context, the context's error.
+func (c *proxyConn) fail(err error) error {
+	c.stop()
+	c.Close()
+	if c.ctx.Err() != nil {
+		return c.ctx.Err()
+	}
+	return err
+}
+
+// done marks the request complete, leaving c with no deadline.
+func (c *proxyConn) done() error {
+	if !c.stop() {
+		// ctx is done; AfterFunc has set, or is about to set, a deadline.
+		return c.fail(c.ctx.Err())
+	}
+	return c.SetDeadline(time.Time{})
+}
+
+// Listener is a listening socket on the proxy service's address space.
+type Listener struct {
+	config ListenConfig
+	key    string
+	addr   addr
+}
+
+var _ net.Listener = &Listener{}
+
+// Accept waits for and returns the next connection to the listener.
+func (l *Listener) Accept() (net.Conn, error) {
+	return l.AcceptContext(context.Background())
+}
+
+// AcceptContext is like Accept, but gives up when ctx is done.
+// The listener's Timeout does not apply to the wait for a connection.
+func (l *Listener) AcceptContext(ctx context.Context) (net.Conn, error) {
+	c, err := connect(ctx, l.config.ProxyAddr, 0, l.config.Logger, "acpt")
+	if err != nil {
+		return nil, err
+	}
 	_, err = fmt.Fprintf(c, "ACCEPT %v\n", l.key)
 	if err != nil {
-		c.Close()
-		return nil, fmt.Errorf("connecting to proxy: %v", err)
+		return nil, c.fail(fmt.Errorf("connecting to proxy: %v", err))
 	}
-	pc := &conn{Conn: c, local: l.addr}
-	_, err = fmt.Fscan(c, &pc.remote)
+	args, err := readResponse(c, 1)
 	if err != nil {
-		c.Close()
-		return nil, fmt.Errorf("bad response from proxy: %v", err)
+		return nil, c.fail(err)
 	}
-	return pc, nil
+	if err := c.done(); err != nil {
+		return nil, err
+	}
+	return &conn{Conn: c, local: l.addr, remote: addr(args[0])}, nil
 }
 
-func (l *listener) Close() error {
-	c, err := net.Dial("tcp", *proxyAddr)
+// Close stops the listener.
+func (l *Listener) Close() error {
+	c, err := connect(context.Background(), l.config.ProxyAddr, l.config.Timeout, l.config.Logger, "clse")
 	if err != nil {
-		return fmt.Errorf("connecting to proxy: %v", err)
+		return err
 	}
-	c = logConn{"clse", c}
 	defer c.Close()
 	_, err = fmt.Fprintf(c, "CLOSE %v\n", l.key)
 	if err != nil {
-		return fmt.Errorf("bad response from proxy: %v", err)
+		return c.fail(fmt.Errorf("connecting to proxy: %v", err))
 	}
-	return nil
+	if _, err := readResponse(c, 0); err != nil {
+		return c.fail(err)
+	}
+	return c.done()
 }
 
-func (l *listener) Addr() net.Addr {
+// Addr returns the listener's address.
+func (l *Listener) Addr() net.Addr {
 	return addr(l.addr)
 }
 
+// Dialer returns a Dialer for the listener's proxy service, with its
+// Timeout and Logger, that dials from the listener's address. Unlike the
+// package-level Dial, it can reach the listener's own group of addresses
+// while the service is partitioned.
+func (l *Listener) Dialer() *Dialer {
+	return &Dialer{
+		ProxyAddr: l.config.ProxyAddr,
+		Timeout:   l.config.Timeout,
+		Logger:    l.config.Logger,
+		LocalAddr: l.addr,
+	}
+}
+
 type conn struct {
 	net.Conn
 	local, remote addr
@@ -123,33 +339,27 @@ type addr string
 func (a addr) Network() string { return "proxy" }
 func (a addr) String() string  { return string(a) }
 
-const verbose = false // log network traffic; for debugging proxy/server
-
+// logConn logs the traffic on a connection to the proxy.
 type logConn struct {
-	prefix string
+	op string
 	net.Conn
+	log *slog.Logger
 }
 
 func (c logConn) Write(b []byte) (n int, err error) {
 	n, err = c.Conn.Write(b)
-	if verbose {
-		log.Printf("%v wr %q (%v)", c.prefix, b, err)
-	}
+	c.log.Info("proxy traffic", "op", c.op, "dir", "out", "data", string(b), "err", err)
 	return
 }
 
 func (c logConn) Read(b []byte) (n int, err error) {
 	n, err = c.Conn.Read(b)
-	if verbose {
-		log.Printf("%v rd %q (%v)", c.prefix, b[:n], err)
-	}
+	c.log.Info("proxy traffic", "op", c.op, "dir", "in", "data", string(b[:n]), "err", err)
 	return
 }
 
 func (c logConn) Close() (err error) {
 	err = c.Conn.Close()
-	if verbose {
-		log.Printf("%v cl (%v)", c.prefix, err)
-	}
+	c.log.Info("proxy traffic", "op", c.op, "dir", "close", "err", err)
 	return
 }
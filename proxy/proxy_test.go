@@ -1,25 +1,28 @@
 package proxy
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 const serverPath = "code.google.com/p/whispering-gophers/proxy/server"
 
-func TestIntegration(t *testing.T) {
-	dir, err := ioutil.TempDir("", "proxy-test")
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer os.RemoveAll(dir)
-
-	bin := filepath.Join(dir, "server")
+// startServer builds the server command and runs it with the given extra
+// flags. It returns the address of the service and, if the flags ask for
+// an admin interface, the admin interface's URL.
+func startServer(t *testing.T, args ...string) (addr, admin string) {
+	bin := filepath.Join(t.TempDir(), "server")
 	build := exec.Command("go", "build", "-o", bin, serverPath)
 	build.Stdout = os.Stdout
 	build.Stderr = os.Stderr
@@ -27,7 +30,7 @@ func TestIntegration(t *testing.T) {
 		t.Fatalf("Building server: %v", err)
 	}
 
-	server := exec.Command(bin, "-addr=localhost:0", "-test")
+	server := exec.Command(bin, append([]string{"-addr=localhost:0", "-test"}, args...)...)
 	stdout, err := server.StdoutPipe()
 	if err != nil {
 		t.Fatalf("Server stdout pipe: %v", err)
@@ -36,12 +39,40 @@ func TestIntegration(t *testing.T) {
 	if err := server.Start(); err != nil {
 		t.Fatalf("Starting server: %v", err)
 	}
-	defer server.Process.Kill()
+	t.Cleanup(func() {
+		server.Process.Kill()
+		server.Wait()
+	})
 
-	if _, err := fmt.Fscan(stdout, proxyAddr); err != nil {
+	if _, err := fmt.Fscan(stdout, &addr); err != nil {
 		t.Fatalf("Scanning server address: %v", err)
 	}
-	t.Logf("Server running on %v", *proxyAddr)
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-admin=") {
+			if _, err := fmt.Fscan(stdout, &admin); err != nil {
+				t.Fatalf("Scanning admin address: %v", err)
+			}
+			admin = "http://" + admin
+		}
+	}
+	t.Logf("Server running on %v", addr)
+	return addr, admin
+}
+
+// post makes a request to the admin interface at admin.
+func post(t *testing.T, admin, path string, form url.Values) {
+	resp, err := http.PostForm(admin+path, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST %v: %v", path, resp.Status)
+	}
+}
+
+func TestIntegration(t *testing.T) {
+	DefaultProxyAddr, _ = startServer(t)
 
 	l, err := Listen()
 	if err != nil {
@@ -119,3 +150,301 @@ func TestIntegration(t *testing.T) {
 		t.Fatal("Listener close error: ", err)
 	}
 }
+
+func TestTwoProxies(t *testing.T) {
+	// Each service hands out the same first address.
+	var dialers [2]Dialer
+	var listeners [2]net.Listener
+	for i := range dialers {
+		proxyAddr, _ := startServer(t)
+		dialers[i].ProxyAddr = proxyAddr
+		lc := ListenConfig{ProxyAddr: proxyAddr}
+		l, err := lc.Listen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		listeners[i] = l
+	}
+	if a0, a1 := listeners[0].Addr(), listeners[1].Addr(); a0.String() != a1.String() {
+		t.Fatalf("listen addresses %v and %v, want the same", a0, a1)
+	}
+
+	for i, d := range dialers {
+		i, d := i, d
+		errc := make(chan error, 1)
+		go func() {
+			c, err := d.Dial(listeners[i].Addr().String())
+			if err == nil {
+				_, err = fmt.Fprintln(c, i)
+				c.Close()
+			}
+			errc <- err
+		}()
+		ac, err := listeners[i].Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ac.Close()
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+		var got int
+		if _, err := fmt.Fscan(ac, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != i {
+			t.Errorf("listener %d received %d", i, got)
+		}
+	}
+}
+
+// silentProxy returns the address of a service that accepts connections
+// but never answers.
+func silentProxy(t *testing.T) string {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { c.Close() })
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// within fails t unless f returns within d.
+func within(t *testing.T, d time.Duration, f func()) {
+	done := make(chan bool)
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(d):
+		t.Fatal("timed out")
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	d := Dialer{ProxyAddr: silentProxy(t)}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	within(t, 5*time.Second, func() {
+		_, err := d.DialContext(ctx, "10.0.0.1")
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("DialContext error = %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+}
+
+func TestDialTimeout(t *testing.T) {
+	d := Dialer{ProxyAddr: silentProxy(t), Timeout: 50 * time.Millisecond}
+	within(t, 5*time.Second, func() {
+		_, err := d.Dial("10.0.0.1")
+		if err == nil || !strings.Contains(err.Error(), "timeout") {
+			t.Errorf("Dial error = %v, want a timeout", err)
+		}
+	})
+}
+
+func TestListenContext(t *testing.T) {
+	lc := ListenConfig{ProxyAddr: silentProxy(t)}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	within(t, 5*time.Second, func() {
+		_, err := lc.ListenContext(ctx)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("ListenContext error = %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+}
+
+func TestAcceptContext(t *testing.T) {
+	proxyAddr, _ := startServer(t)
+	lc := ListenConfig{ProxyAddr: proxyAddr}
+	l, err := lc.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	within(t, 5*time.Second, func() {
+		_, err := l.(*Listener).AcceptContext(ctx)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("AcceptContext error = %v, want %v", err, context.Canceled)
+		}
+	})
+
+	// The cancelled accept must not take the next connection.
+	time.Sleep(50 * time.Millisecond) // for the service to see it go
+	d := Dialer{ProxyAddr: lc.ProxyAddr}
+	errc := make(chan error, 1)
+	go func() {
+		c, err := d.Dial(l.Addr().String())
+		if err == nil {
+			_, err = fmt.Fprintln(c, "hi")
+			c.Close()
+		}
+		errc <- err
+	}()
+	within(t, 5*time.Second, func() {
+		c, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+		var s string
+		if _, err := fmt.Fscan(c, &s); err != nil || s != "hi" {
+			t.Errorf("accepted connection read %q, %v; want \"hi\"", s, err)
+		}
+	})
+	if err := <-errc; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAcceptTimeout(t *testing.T) {
+	proxyAddr, _ := startServer(t, "-accept-timeout=50ms")
+	lc := ListenConfig{ProxyAddr: proxyAddr}
+	l, err := lc.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	d := Dialer{ProxyAddr: proxyAddr}
+	within(t, 5*time.Second, func() {
+		if _, err := d.Dial(l.Addr().String()); err != ErrAcceptTimeout {
+			t.Errorf("Dial error = %v, want %v", err, ErrAcceptTimeout)
+		}
+	})
+}
+
+func TestErrors(t *testing.T) {
+	proxyAddr, _ := startServer(t)
+	d := Dialer{ProxyAddr: proxyAddr}
+	if _, err := d.Dial("10.9.9.9"); !errors.Is(err, ErrUnknownAddress) {
+		t.Errorf("Dial of unknown address: %v, want %v", err, ErrUnknownAddress)
+	}
+
+	lc := ListenConfig{ProxyAddr: proxyAddr}
+	ln, err := lc.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := ln.(*Listener)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := l.AcceptContext(ctx)
+		errc <- err
+	}()
+	// Wait for the first Accept to reach the service before superseding it.
+	time.Sleep(50 * time.Millisecond)
+	go l.AcceptContext(ctx)
+	if err := <-errc; !errors.Is(err, ErrDuplicateAccept) {
+		t.Errorf("superseded Accept: %v, want %v", err, ErrDuplicateAccept)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("second Close: %v, want %v", err, ErrUnknownKey)
+	}
+	if _, err := l.Accept(); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Accept after Close: %v, want %v", err, ErrUnknownKey)
+	}
+}
+
+func TestPartition(t *testing.T) {
+	proxyAddr, admin := startServer(t, "-admin=localhost:0")
+	lc := ListenConfig{ProxyAddr: proxyAddr}
+	var ls [2]net.Listener
+	for i := range ls {
+		l, err := lc.Listen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		ls[i] = l
+	}
+	post(t, admin, "/partition", url.Values{"group": {ls[0].Addr().String(), ls[1].Addr().String()}})
+	d := Dialer{ProxyAddr: lc.ProxyAddr, LocalAddr: ls[0].Addr()}
+	if _, err := d.Dial(ls[1].Addr().String()); !errors.Is(err, ErrUnreachable) {
+		t.Errorf("Dial across partition: %v, want %v", err, ErrUnreachable)
+	}
+	anon := Dialer{ProxyAddr: lc.ProxyAddr}
+	if _, err := anon.Dial(ls[1].Addr().String()); !errors.Is(err, ErrUnreachable) {
+		t.Errorf("Dial without LocalAddr during partition: %v, want %v", err, ErrUnreachable)
+	}
+
+	// Listeners on the default service dial within their own group.
+	DefaultProxyAddr = lc.ProxyAddr
+	var same [2]net.Listener
+	for i := range same {
+		l, err := Listen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		same[i] = l
+	}
+	post(t, admin, "/partition", url.Values{"group": {
+		ls[0].Addr().String(),
+		ls[1].Addr().String(),
+		same[0].Addr().String() + "," + same[1].Addr().String(),
+	}})
+	if _, err := Dial(same[1].Addr().String()); !errors.Is(err, ErrUnreachable) {
+		t.Errorf("package-level Dial during partition: %v, want %v", err, ErrUnreachable)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		c, err := same[0].(*Listener).Dialer().Dial(same[1].Addr().String())
+		if err == nil {
+			c.Close()
+		}
+		errc <- err
+	}()
+	c, err := same[1].Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if err := <-errc; err != nil {
+		t.Errorf("Dial within group: %v", err)
+	}
+	if got, want := c.RemoteAddr().String(), same[0].Addr().String(); got != want {
+		t.Errorf("accepted connection from %v, want %v", got, want)
+	}
+
+	post(t, admin, "/heal", nil)
+	go func() {
+		c, err := d.Dial(ls[1].Addr().String())
+		if err == nil {
+			c.Close()
+		}
+		errc <- err
+	}()
+	c, err = ls[1].Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.RemoteAddr().String(), ls[0].Addr().String(); got != want {
+		t.Errorf("accepted connection from %v, want %v", got, want)
+	}
+}
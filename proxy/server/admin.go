@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// AdminHandler returns an HTTP handler through which the server's network
+// conditions can be inspected and changed at runtime:
+//
+//	GET  /impair             list impairments, one "addr rule" per line,
+//	                         with "*" for the default
+//	POST /impair addr= rule= set the impairment of the listener at addr, or
+//	                         the default if addr is empty or "*"; rule is
+//	                         as for ParseImpairment
+//	GET  /partition          list the partition's groups, one per line
+//	POST /partition group= kill=
+//	                         partition the address space; each group value
+//	                         is a comma-separated list of addresses, and
+//	                         kill=1 resets connections between groups
+//	POST /heal               remove the partition
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/impair", s.handleImpair)
+	mux.HandleFunc("/partition", s.handlePartition)
+	mux.HandleFunc("/heal", s.handleHeal)
+	return mux
+}
+
+func (s *Server) handleImpair(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		im, err := ParseImpairment(r.FormValue("rule"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		addr := r.FormValue("addr")
+		if addr == "*" {
+			addr = ""
+		}
+		s.SetImpairment(addr, im)
+		slog.Info("impairment", "addr", addr, "rule", im)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	m := s.Impairments()
+	for _, addr := range sortedAddrs(m) {
+		name := addr
+		if name == "" {
+			name = "*"
+		}
+		fmt.Fprintln(w, name, m[addr])
+	}
+}
+
+func (s *Server) handlePartition(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var groups [][]string
+		for _, g := range r.Form["group"] {
+			groups = append(groups, strings.FieldsFunc(g, func(r rune) bool {
+				return r == ',' || r == ' '
+			}))
+		}
+		if len(groups) == 0 {
+			http.Error(w, "no groups", http.StatusBadRequest)
+			return
+		}
+		s.Partition(groups, r.FormValue("kill") == "1")
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, g := range s.Groups() {
+		fmt.Fprintln(w, strings.Join(g, " "))
+	}
+}
+
+func (s *Server) handleHeal(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.Heal()
+}
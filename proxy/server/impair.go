@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An Impairment describes the network conditions to emulate on the
+// connections to a listener. The zero Impairment passes data unchanged.
+type Impairment struct {
+	Latency   time.Duration // delay added to all data
+	Jitter    time.Duration // further random delay, up to this much
+	Bandwidth int           // bytes per second in each direction; zero is unlimited
+	Reset     float64       // chance of resetting the connection per read
+	Stall     float64       // chance of stalling the connection per read
+	StallFor  time.Duration // length of a stall
+}
+
+// errReset is reported when an impairment resets a connection.
+var errReset = errors.New("connection reset by impairment")
+
+// ParseImpairment parses an impairment in the form returned by
+// Impairment.String: comma-separated settings such as
+//
+//	latency=100ms,jitter=20ms,bandwidth=64000,reset=0.001,stall=0.01,stall-for=2s
+//
+// Settings left out are zero. "none" is the zero Impairment.
+func ParseImpairment(s string) (Impairment, error) {
+	var im Impairment
+	if s == "" || s == "none" {
+		return im, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return im, fmt.Errorf("bad impairment setting %q", kv)
+		}
+		var err error
+		switch k {
+		case "latency":
+			im.Latency, err = time.ParseDuration(v)
+		case "jitter":
+			im.Jitter, err = time.ParseDuration(v)
+		case "bandwidth":
+			im.Bandwidth, err = strconv.Atoi(v)
+		case "reset":
+			im.Reset, err = strconv.ParseFloat(v, 64)
+		case "stall":
+			im.Stall, err = strconv.ParseFloat(v, 64)
+		case "stall-for":
+			im.StallFor, err = time.ParseDuration(v)
+		default:
+			return im, fmt.Errorf("unknown impairment setting %q", k)
+		}
+		if err != nil {
+			return im, fmt.Errorf("bad impairment setting %q: %v", kv, err)
+		}
+	}
+	if im.Latency < 0 || im.Jitter < 0 || im.Bandwidth < 0 || im.StallFor < 0 ||
+		im.Reset < 0 || im.Reset > 1 || im.Stall < 0 || im.Stall > 1 {
+		return im, fmt.Errorf("impairment out of range: %q", s)
+	}
+	return im, nil
+}
+
+// String returns im in the form accepted by ParseImpairment.
+func (im Impairment) String() string {
+	var l []string
+	if im.Latency != 0 {
+		l = append(l, "latency="+im.Latency.String())
+	}
+	if im.Jitter != 0 {
+		l = append(l, "jitter="+im.Jitter.String())
+	}
+	if im.Bandwidth != 0 {
+		l = append(l, "bandwidth="+strconv.Itoa(im.Bandwidth))
+	}
+	if im.Reset != 0 {
+		l = append(l, "reset="+strconv.FormatFloat(im.Reset, 'g', -1, 64))
+	}
+	if im.Stall != 0 {
+		l = append(l, "stall="+strconv.FormatFloat(im.Stall, 'g', -1, 64))
+	}
+	if im.StallFor != 0 {
+		l = append(l, "stall-for="+im.StallFor.String())
+	}
+	if len(l) == 0 {
+		return "none"
+	}
+	return strings.Join(l, ",")
+}
+
+// delay returns the time a chunk of data is held back.
+func (im Impairment) delay() time.Duration {
+	d := im.Latency
+	if im.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(im.Jitter) + 1))
+	}
+	return d
+}
+
+// SetImpairment sets the impairment of connections to the listener at addr,
+// or, if addr is empty, of those to listeners that have none of their own.
+// It applies to data sent after the call, including on open connections.
+// The zero Impairment removes the setting.
+func (s *Server) SetImpairment(addr string, im Impairment) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if im == (Impairment{}) {
+		delete(s.impair, addr)
+		return
+	}
+	s.impair[addr] = im
+}
+
+// Impairments returns the impairments set, by address; the empty address
+// is the default.
+func (s *Server) Impairments() map[string]Impairment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := make(map[string]Impairment, len(s.impair))
+	for addr, im := range s.impair {
+		m[addr] = im
+	}
+	return m
+}
+
+func (s *Server) impairment(addr string) Impairment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if im, ok := s.impair[addr]; ok {
+		return im
+	}
+	return s.impair[""]
+}
+
+// sortedAddrs returns the keys of m in order.
+func sortedAddrs(m map[string]Impairment) []string {
+	l := make([]string, 0, len(m))
+	for addr := range m {
+		l = append(l, addr)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// chunk is data read from one side of a proxied connection, to be written
+// to the other at due.
+type chunk struct {
+	b   []byte
+	due time.Time
+	err error // read error after b
+}
+
+// pipe copies from r to w, as io.Copy does, impairing the data as set for
+// the listener at addr. It gives up waiting to write when stop is closed or
+// the server is.
+func (s *Server) pipe(errc chan<- error, stop <-chan struct{}, w, r net.Conn, addr string) {
+	ch := make(chan chunk, 64)
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		var last time.Time
+		for {
+			b := make([]byte, 32<<10)
+			n, err := r.Read(b)
+			im := s.impairment(addr)
+			if n > 0 && im.Reset > 0 && rand.Float64() < im.Reset {
+				n, err = 0, errReset
+			}
+			c := chunk{b: b[:n], due: time.Now().Add(im.delay()), err: err}
+			if c.due.Before(last) {
+				c.due = last // keep the data in order
+			}
+			last = c.due
+			select {
+			case ch <- c:
+			case <-quit:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	for c := range ch {
+		if !s.wait(time.Until(c.due), stop) {
+			errc <- nil
+			return
+		}
+		im := s.impairment(addr)
+		if im.Stall > 0 && rand.Float64() < im.Stall && !s.wait(im.StallFor, stop) {
+			errc <- nil
+			return
+		}
+		for b := c.b; len(b) > 0; {
+			n := len(b)
+			if im.Bandwidth > 0 && n > burst(im.Bandwidth) {
+				n = burst(im.Bandwidth)
+			}
+			if _, err := w.Write(b[:n]); err != nil {
+				errc <- err
+				return
+			}
+			b = b[n:]
+			if im.Bandwidth > 0 && !s.wait(time.Duration(n)*time.Second/time.Duration(im.Bandwidth), stop) {
+				errc <- nil
+				return
+			}
+		}
+		switch c.err {
+		case nil:
+			continue
+		case errReset:
+			reset(w)
+			reset(r)
+			errc <- errReset
+		default:
+			if errors.Is(c.err, io.EOF) {
+				c.err = nil
+			}
+			errc <- c.err
+		}
+		return
+	}
+}
+
+// burst is the most data written at once under a bandwidth cap, so that
+// the cap holds over any tenth of a second.
+func burst(bandwidth int) int {
+	if bandwidth < 10 {
+		return 1
+	}
+	return bandwidth / 10
+}
+
+// wait sleeps for d and reports true, or reports false as soon as stop is
+// closed or the server is.
+func (s *Server) wait(d time.Duration, stop <-chan struct{}) bool {
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-stop:
+	case <-s.done:
+	}
+	return false
+}
+
+// reset closes c, with a TCP reset if possible.
+func reset(c net.Conn) {
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	c.Close()
+}
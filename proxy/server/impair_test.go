@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// request sends cmd to the service at srvAddr and returns the connection
+// and the arguments of its OK response.
+func request(t *testing.T, srvAddr, cmd string) (net.Conn, []string) {
+	c, err := net.Dial("tcp", srvAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(c, cmd)
+	line, err := readLine(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := strings.Fields(line)
+	if len(f) == 0 || f[0] != "OK" {
+		t.Fatalf("%v answered %q", cmd, line)
+	}
+	return c, f[1:]
+}
+
+// proxied returns the ends of a connection proxied by s, and the address of
+// the listener it was made to.
+func proxied(t *testing.T, s *Server) (dialer, acceptor net.Conn, addr string) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	go s.Serve(ln)
+	srvAddr := ln.Addr().String()
+
+	c, args := request(t, srvAddr, "LISTEN")
+	c.Close()
+	addr, key := args[0], args[1]
+	ch := make(chan net.Conn)
+	go func() {
+		c, _ := request(t, srvAddr, "ACCEPT "+key)
+		ch <- c
+	}()
+	dialer, _ = request(t, srvAddr, "DIAL "+addr)
+	acceptor = <-ch
+	t.Cleanup(func() {
+		dialer.Close()
+		acceptor.Close()
+	})
+	return dialer, acceptor, addr
+}
+
+func TestParseImpairment(t *testing.T) {
+	for _, s := range []string{
+		"none",
+		"latency=100ms",
+		"latency=1s,jitter=20ms,bandwidth=64000,reset=0.001,stall=0.5,stall-for=2s",
+	} {
+		im, err := ParseImpairment(s)
+		if err != nil {
+			t.Errorf("ParseImpairment(%q): %v", s, err)
+			continue
+		}
+		if got := im.String(); got != s {
+			t.Errorf("ParseImpairment(%q).String() = %q", s, got)
+		}
+	}
+	for _, s := range []string{"latency", "latency=x", "speed=1", "reset=2", "jitter=-1s"} {
+		if _, err := ParseImpairment(s); err == nil {
+			t.Errorf("ParseImpairment(%q) succeeded", s)
+		}
+	}
+}
+
+func TestImpairLatency(t *testing.T) {
+	s := NewServer()
+	d, a, addr := proxied(t, s)
+	const latency = 100 * time.Millisecond
+	s.SetImpairment(addr, Impairment{Latency: latency})
+
+	start := time.Now()
+	fmt.Fprintln(d, "ping")
+	a.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := readLine(a); err != nil {
+		t.Fatal(err)
+	}
+	if el := time.Since(start); el < latency {
+		t.Errorf("data arrived after %v, want at least %v", el, latency)
+	}
+}
+
+func TestImpairReset(t *testing.T) {
+	s := NewServer()
+	s.SetImpairment("", Impairment{Reset: 1})
+	d, a, _ := proxied(t, s)
+
+	fmt.Fprintln(d, "ping")
+	a.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := ioutil.ReadAll(a)
+	if len(b) != 0 {
+		t.Errorf("read %q through a reset connection", b)
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("connection not reset")
+	}
+}
+
+func TestImpairBandwidth(t *testing.T) {
+	s := NewServer()
+	s.SetImpairment("", Impairment{Bandwidth: 1000})
+	d, a, _ := proxied(t, s)
+
+	start := time.Now()
+	d.Write(make([]byte, 300))
+	a.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 300)
+	n, err := a.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n > 100 {
+		t.Errorf("first read got %d bytes at 1000 bytes/s, want at most 100", n)
+	}
+	if _, err := io.ReadFull(a, b[n:]); err != nil {
+		t.Fatal(err)
+	}
+	if el := time.Since(start); el < 200*time.Millisecond {
+		t.Errorf("300 bytes at 1000 bytes/s took %v, want at least 200ms", el)
+	}
+}
+
+func TestWaitClose(t *testing.T) {
+	s := NewServer()
+	done := make(chan bool)
+	go func() { done <- s.wait(time.Hour, nil) }()
+	s.Close()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("wait reported a full sleep")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait not interrupted by Close")
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	s := NewServer()
+	ts := httptest.NewServer(s.AdminHandler())
+	defer ts.Close()
+
+	resp, err := http.PostForm(ts.URL+"/impair", url.Values{"addr": {"10.0.0.1"}, "rule": {"latency=50ms"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = http.PostForm(ts.URL+"/impair", url.Values{"rule": {"bogus"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad rule answered %v, want %v", resp.Status, http.StatusBadRequest)
+	}
+	if im := s.impairment("10.0.0.1"); im.Latency != 50*time.Millisecond {
+		t.Errorf("impairment of 10.0.0.1 = %v, want latency=50ms", im)
+	}
+
+	resp, err = http.Get(ts.URL + "/impair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "10.0.0.1 latency=50ms\n"; string(b) != want {
+		t.Errorf("GET /impair = %q, want %q", b, want)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+)
+
+var (
+	listenAddr = flag.String("addr", "localhost:2000", "listen address")
+	testMode   = flag.Bool("test", false, "print listen address, then that of the admin interface if any (for integration test)")
+	acceptWait = flag.Duration("accept-timeout", DefaultAcceptTimeout, "how long a dial waits to be accepted (negative: forever)")
+	adminAddr  = flag.String("admin", "", "address of the HTTP admin interface (none if empty)")
+	impair     = flag.String("impair", "", "impairment of all connections, such as latency=100ms,jitter=20ms,bandwidth=64000,reset=0.001,stall=0.01,stall-for=2s")
+	logLevel   slog.Level
+)
+
+func main() {
+	flag.TextVar(&logLevel, "log-level", slog.LevelInfo, "minimum level of log messages: debug, info, warn or error")
+	flag.Parse()
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})))
+
+	s := NewServer()
+	s.AcceptTimeout = *acceptWait
+	im, err := ParseImpairment(*impair)
+	if err != nil {
+		fatal(err)
+	}
+	s.SetImpairment("", im)
+	var admin net.Listener
+	if *adminAddr != "" {
+		admin, err = net.Listen("tcp", *adminAddr)
+		if err != nil {
+			fatal(err)
+		}
+		slog.Info("admin interface", "addr", admin.Addr())
+		go func() {
+			fatal(http.Serve(admin, s.AdminHandler()))
+		}()
+	}
+
+	l, err := net.Listen("tcp", *listenAddr)
+	if err != nil {
+		fatal(err)
+	}
+	slog.Info("listening", "addr", l.Addr())
+	if *testMode {
+		fmt.Println(l.Addr())
+		if admin != nil {
+			fmt.Println(admin.Addr())
+		}
+	}
+	fatal(s.Serve(l))
+}
+
+func fatal(err error) {
+	slog.Error("fatal", "err", err)
+	os.Exit(1)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+)
+
+// A partition splits the virtual network into groups of addresses that
+// can reach only each other, to simulate a netsplit. While one is in force,
+// a dialer must give its own address in the DIAL command to reach any
+// address at all.
+
+// link is an open proxied connection between two addresses.
+type link struct {
+	from, to string
+	c, c2    net.Conn
+}
+
+// Partition splits the address space into groups. Afterwards a DIAL from an
+// address in one group to an address in another is refused with
+// CodeUnreachable, as are calls from one group to another still waiting to
+// be accepted. Addresses in no group form a group of their own. A DIAL
+// that doesn't give the dialer's address is refused too, since its group is
+// unknown. If kill is set, open connections between groups, or from unknown
+// addresses, are reset.
+// A partition replaces any earlier one.
+func (s *Server) Partition(groups [][]string, kill bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.group = map[string]int{}
+	s.groups = nil
+	for i, g := range groups {
+		s.groups = append(s.groups, append([]string(nil), g...))
+		for _, addr := range g {
+			s.group[addr] = i + 1
+		}
+	}
+	slog.Info("partition", "groups", s.groups, "kill", kill)
+	if !kill {
+		return
+	}
+	for k := range s.links {
+		if !s.reachable(k.from, k.to) {
+			slog.Info("killing link", "from", k.from, "to", k.to)
+			reset(k.c)
+			reset(k.c2)
+		}
+	}
+}
+
+// Heal removes the partition, if any.
+func (s *Server) Heal() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.group, s.groups = nil, nil
+	slog.Info("healed partition")
+}
+
+// Groups returns the groups of the current partition, or nil if there is
+// none.
+func (s *Server) Groups() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := make([][]string, len(s.groups))
+	for i, g := range s.groups {
+		l[i] = append([]string(nil), g...)
+	}
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+// reachable reports whether the partition allows a connection from one
+// address to another. The caller must hold s.mu.
+func (s *Server) reachable(from, to string) bool {
+	if s.group == nil {
+		return true
+	}
+	return from != "" && s.group[from] == s.group[to]
+}
+
+// connect records the link k while it is open, unless the partition forbids
+// it, in which case it reports false. The returned func forgets k.
+func (s *Server) connect(k *link) (bool, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.reachable(k.from, k.to) {
+		return false, nil
+	}
+	s.links[k] = true
+	return true, func() {
+		s.mu.Lock()
+		delete(s.links, k)
+		s.mu.Unlock()
+	}
+}
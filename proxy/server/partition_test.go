@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// dialFrom asks the service at srvAddr to connect from one address to the
+// listener with the given address and key, and returns the dialer's end,
+// or, if the dial fails, the response line.
+func dialFrom(t *testing.T, srvAddr, from, to, key string) (net.Conn, string) {
+	a, err := net.Dial("tcp", srvAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	fmt.Fprintln(a, "ACCEPT", key)
+	c, err := net.Dial("tcp", srvAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	fmt.Fprintln(c, "DIAL", to, from)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := readLine(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Time{})
+	if line != "OK" {
+		return nil, line
+	}
+	return c, ""
+}
+
+func TestPartition(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer()
+	defer s.Close()
+	go s.Serve(ln)
+	srvAddr := ln.Addr().String()
+
+	var addr, key [3]string
+	for i := range addr {
+		c, args := request(t, srvAddr, "LISTEN")
+		c.Close()
+		addr[i], key[i] = args[0], args[1]
+	}
+
+	// A link from 0 to 2 made before the partition.
+	old, code := dialFrom(t, srvAddr, addr[0], addr[2], key[2])
+	if code != "" {
+		t.Fatalf("dial before partition: %v", code)
+	}
+
+	s.Partition([][]string{{addr[0], addr[1]}}, true)
+	if _, code := dialFrom(t, srvAddr, addr[0], addr[1], key[1]); code != "" {
+		t.Errorf("dial within group: %v", code)
+	}
+	if _, code := dialFrom(t, srvAddr, addr[0], addr[2], key[2]); code != "ERROR "+CodeUnreachable {
+		t.Errorf("dial across partition answered %q, want ERROR %v", code, CodeUnreachable)
+	}
+	if _, code := dialFrom(t, srvAddr, "", addr[1], key[1]); code != "ERROR "+CodeUnreachable {
+		t.Errorf("dial from unknown address answered %q, want ERROR %v", code, CodeUnreachable)
+	}
+	old.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(old); err == nil {
+		t.Error("link across partition not reset")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("link across partition still open")
+	}
+
+	s.Heal()
+	if _, code := dialFrom(t, srvAddr, addr[0], addr[2], key[2]); code != "" {
+		t.Errorf("dial after heal: %v", code)
+	}
+}
+
+func TestAdminPartition(t *testing.T) {
+	s := NewServer()
+	ts := httptest.NewServer(s.AdminHandler())
+	defer ts.Close()
+
+	resp, err := http.PostForm(ts.URL+"/partition", url.Values{"group": {"10.0.0.1,10.0.0.2", "10.0.0.3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "10.0.0.1 10.0.0.2\n10.0.0.3\n"; string(b) != want {
+		t.Errorf("POST /partition = %q, want %q", b, want)
+	}
+	s.mu.Lock()
+	cut := !s.reachable("10.0.0.1", "10.0.0.3")
+	s.mu.Unlock()
+	if !cut {
+		t.Error("10.0.0.3 reachable from 10.0.0.1 after partition")
+	}
+
+	resp, err = http.PostForm(ts.URL+"/heal", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if g := s.Groups(); g != nil {
+		t.Errorf("Groups after heal = %v, want nil", g)
+	}
+}
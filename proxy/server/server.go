@@ -1,93 +1,259 @@
 // The server command is a multiplexer service for proxied TCP connections.
 // Its clients access it through the code.google.com/p/whispering-gophers/proxy package.
+//
+// A client makes each request on a new connection, by sending one of these
+// command lines:
+//
+//	LISTEN        reserve an address; answered OK <addr> <key>
+//	ACCEPT <key>  wait for a connection to the listener with the key;
+//	              answered OK <remote addr>, the dialer's own address if
+//	              it gave one
+//	DIAL <addr> [<from>]
+//	              connect to the listener at addr, from the dialer's own
+//	              address if given; answered OK once accepted
+//	CLOSE <key>   release the listener with the key; answered OK
+//
+// After a successful ACCEPT or DIAL the connection carries the proxied
+// stream. A request that fails is answered with a line
+//
+//	ERROR <code>
+//
+// where code is one of the Code constants, and the connection is closed.
+//
+// This grammar is not compatible with the original protocol, whose answers
+// had no OK or ERROR and which old clients still expect. Their LISTEN,
+// which carried an argument, is refused as a bad command; such clients must
+// be updated to the current proxy package.
 package main
 
 import (
 	"crypto/rand"
-	"flag"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"os"
+	"strings"
 	"sync"
+	"time"
 )
 
-var (
-	listenAddr = flag.String("addr", "localhost:2000", "listen address")
-	testMode   = flag.Bool("test", false, "print listen address (for integration test)")
+// ErrServerClosed is returned by Serve after Close is called.
+var ErrServerClosed = errors.New("server: Server closed")
+
+// Error codes sent in ERROR responses.
+const (
+	CodeBadCommand      = "bad-command"      // malformed or unknown command
+	CodeUnknownKey      = "unknown-key"      // ACCEPT or CLOSE of no listener
+	CodeUnknownAddress  = "unknown-address"  // DIAL of no listener
+	CodeDuplicateAccept = "duplicate-accept" // superseded by a later ACCEPT
+	CodeTimeout         = "timeout"          // DIAL not accepted in time
+	CodeUnreachable     = "unreachable"      // DIAL across a partition
 )
 
-func main() {
-	flag.Parse()
+// commandTimeout bounds the time a client may take to send its command,
+// and maxCommand its length.
+var commandTimeout = 10 * time.Second
 
-	s := NewServer()
-	l, err := net.Listen("tcp", *listenAddr)
-	if err != nil {
-		log.Fatal(err)
-	}
-	if *testMode {
-		fmt.Println(l.Addr())
-	}
-	for {
-		c, err := l.Accept()
-		if err != nil {
-			log.Fatal(err)
-		}
-		go s.Serve(c)
-	}
-}
+const maxCommand = 256
+
+// DefaultAcceptTimeout is the default time a dialer waits for its connection
+// to be accepted.
+const DefaultAcceptTimeout = 30 * time.Second
 
 // Server tracks Listeners and the address pool.
 type Server struct {
+	// AcceptTimeout is how long a DIAL waits for the listener to accept it
+	// before being answered "ERROR timeout". Zero means DefaultAcceptTimeout;
+	// a negative value means dialers wait indefinitely.
+	// It must be set before Serve is called.
+	AcceptTimeout time.Duration
+
 	mu     sync.Mutex
 	key    map[string]*Listener
 	addr   map[string]*Listener
 	lastIP net.IP
+	impair map[string]Impairment
+	group  map[string]int // partition group of each address; see Partition
+	groups [][]string
+	links  map[*link]bool
+
+	closed    bool
+	done      chan struct{} // closed by Close
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
 }
 
+// NewServer returns a Server with an empty address pool.
 func NewServer() *Server {
 	return &Server{
-		key:    map[string]*Listener{},
-		addr:   map[string]*Listener{},
-		lastIP: net.IP{10, 0, 0, 0},
+		key:       map[string]*Listener{},
+		addr:      map[string]*Listener{},
+		lastIP:    net.IP{10, 0, 0, 0},
+		impair:    map[string]Impairment{},
+		links:     map[*link]bool{},
+		listeners: map[net.Listener]bool{},
+		conns:     map[net.Conn]bool{},
+		done:      make(chan struct{}),
 	}
 }
 
-func (s *Server) Serve(c net.Conn) {
-	var cmd, arg string
-	_, err := fmt.Fscan(c, &cmd, &arg)
-	if err != nil {
-		log.Println("%v: bad command:", c.RemoteAddr(), err)
+// Serve accepts client connections on l and serves each in a new
+// goroutine. It returns when l fails or the server is closed; in the latter
+// case it returns ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listeners[l] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go s.ServeConn(c)
+	}
+}
+
+// Close stops the server: it closes the listeners passed to Serve, every
+// client connection, and every virtual listener.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	var err error
+	for l := range s.listeners {
+		if e := l.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	for key, l := range s.key {
+		l.close <- true
+		delete(s.key, key)
+		delete(s.addr, l.Addr)
+	}
+	return err
+}
+
+// track records c as active, or forgets it if add is false. It reports
+// false if the server is closed, in which case c must not be used.
+func (s *Server) track(c net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.conns, c)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	s.conns[c] = true
+	return true
+}
+
+// ServeConn handles a single client connection, reading its command and
+// carrying it out.
+func (s *Server) ServeConn(c net.Conn) {
+	if !s.track(c, true) {
 		c.Close()
 		return
 	}
-	switch cmd {
-	case "LISTEN":
-		s.Listen(c)
-	case "ACCEPT":
-		s.Accept(c, arg)
-	case "CLOSE":
-		s.Close(c, arg)
-	case "DIAL":
-		s.Dial(c, arg)
+	defer s.track(c, false)
+
+	c.SetReadDeadline(time.Now().Add(commandTimeout))
+	line, err := readLine(c)
+	if err != nil {
+		slog.Warn("bad command", "remote", c.RemoteAddr(), "err", err)
+		reject(c, CodeBadCommand)
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+	f := strings.Fields(line)
+	slog.Debug("command", "remote", c.RemoteAddr(), "cmd", f)
+	switch {
+	case len(f) == 1 && f[0] == "LISTEN":
+		s.listen(c)
+	case len(f) == 2 && f[0] == "ACCEPT":
+		s.accept(c, f[1])
+	case len(f) == 2 && f[0] == "CLOSE":
+		s.close(c, f[1])
+	case len(f) == 2 && f[0] == "DIAL":
+		s.dial(c, f[1], "")
+	case len(f) == 3 && f[0] == "DIAL":
+		s.dial(c, f[1], f[2])
 	default:
-		log.Println("%v: bad command:", c.RemoteAddr(), cmd)
-		c.Close()
+		slog.Warn("bad command", "remote", c.RemoteAddr(), "cmd", f)
+		reject(c, CodeBadCommand)
 	}
 }
 
-func (s *Server) Listen(c net.Conn) {
+// readLine reads a line from c, a byte at a time so as not to consume any
+// of the stream that may follow it.
+func readLine(c net.Conn) (string, error) {
+	var b []byte
+	buf := make([]byte, 1)
+	for len(b) < maxCommand {
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return "", err
+		}
+		if buf[0] == '\n' {
+			return string(b), nil
+		}
+		b = append(b, buf[0])
+	}
+	return "", errors.New("command too long")
+}
+
+// reject answers a failed request with code and closes c.
+func reject(c net.Conn, code string) {
+	defer c.Close()
+	c.SetWriteDeadline(time.Now().Add(time.Second))
+	fmt.Fprintln(c, "ERROR", code)
+}
+
+func (s *Server) listen(c net.Conn) {
 	s.mu.Lock()
 	incIP(s.lastIP)
 	addr, key := s.lastIP.String(), genkey()
-	l := NewListener(addr)
+	l := NewListener(addr, s.acceptTimeout())
 	s.key[key] = l
 	s.addr[addr] = l
 	s.mu.Unlock()
-	fmt.Fprintln(c, addr, key)
+	slog.Info("listen", "remote", c.RemoteAddr(), "addr", addr)
+	fmt.Fprintln(c, "OK", addr, key)
 	c.Close()
 }
 
+func (s *Server) acceptTimeout() time.Duration {
+	if s.AcceptTimeout != 0 {
+		return s.AcceptTimeout
+	}
+	return DefaultAcceptTimeout
+}
+
 func incIP(ip net.IP) {
 	ip[3]++
 	if ip[3] == 0 {
@@ -105,88 +271,220 @@ func genkey() string {
 	return fmt.Sprintf("%x", b[:n])
 }
 
-func (s *Server) Accept(c net.Conn, key string) {
-	defer c.Close()
-
+func (s *Server) accept(c net.Conn, key string) {
 	s.mu.Lock()
 	l, ok := s.key[key]
 	s.mu.Unlock()
 	if !ok {
-		fmt.Fprintln(c, "ERROR unknown key")
+		slog.Warn("accept on unknown key", "remote", c.RemoteAddr())
+		reject(c, CodeUnknownKey)
 		return
 	}
 
-	ch := make(chan net.Conn)
-	l.accept <- ch
-	c2 := <-ch
-	if c2 == nil {
-		fmt.Fprintln(c2, "ERROR duplicate accept")
-		return
+	gone, stop := watch(c)
+	var d *call
+	for {
+		var code string
+		d, code = l.next(gone)
+		if d == nil && code == "" {
+			slog.Info("accept abandoned", "addr", l.Addr, "remote", c.RemoteAddr())
+			stop()
+			c.Close()
+			return
+		}
+		if code != "" {
+			stop()
+			reject(c, code)
+			return
+		}
+		ok, forget := s.connect(&link{from: d.from, to: l.Addr, c: c, c2: d.c})
+		if !ok {
+			slog.Info("dial across partition", "addr", l.Addr, "from", d.from)
+			go reject(d.c, CodeUnreachable)
+			continue
+		}
+		if _, err := fmt.Fprintln(d.c, "OK"); err == nil {
+			defer forget()
+			stop()
+			break
+		}
+		// The dialer gave up waiting; take the next one.
+		forget()
+		d.c.Close()
 	}
+	c2 := d.c
+	defer c.Close()
 	defer c2.Close()
-	fmt.Fprintln(c2, "OK")
-	fmt.Fprintln(c, c2.RemoteAddr())
+	remote := d.from
+	if remote == "" {
+		remote = c2.RemoteAddr().String()
+	}
+	fmt.Fprintln(c, "OK", remote)
+	slog.Info("connected", "addr", l.Addr, "remote", c2.RemoteAddr(), "from", d.from)
 
-	errc := make(chan error, 1)
-	go cp(errc, c, c2)
-	go cp(errc, c2, c)
+	errc := make(chan error, 2)
+	quit := make(chan struct{})
+	defer close(quit)
+	go s.pipe(errc, quit, c, c2, l.Addr)
+	go s.pipe(errc, quit, c2, c, l.Addr)
 	if err := <-errc; err != nil {
-		log.Println(err)
+		slog.Warn("copy error", "addr", l.Addr, "remote", c2.RemoteAddr(), "err", err)
 	}
 }
 
-func cp(errc chan error, w io.Writer, r io.Reader) {
-	_, err := io.Copy(w, r)
-	errc <- err
+// watch watches c, on which a client waits for its request to be answered,
+// and closes gone if the client goes away. stop ends the watch.
+func watch(c net.Conn) (gone <-chan struct{}, stop func()) {
+	ch := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var b [1]byte
+		// The client sends nothing until answered, so any read result
+		// other than our own deadline means it is gone.
+		if _, err := c.Read(b[:]); errors.Is(err, os.ErrDeadlineExceeded) {
+			return
+		}
+		close(ch)
+	}()
+	return ch, func() {
+		c.SetReadDeadline(time.Unix(1, 0))
+		<-done
+		c.SetReadDeadline(time.Time{})
+	}
 }
 
-func (s *Server) Close(c net.Conn, key string) {
+func (s *Server) close(c net.Conn, key string) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 	l, ok := s.key[key]
+	if ok {
+		l.close <- true
+		delete(s.key, key)
+		delete(s.addr, l.Addr)
+	}
+	s.mu.Unlock()
 	if !ok {
-		fmt.Fprintln(c, "ERROR unknown key")
+		slog.Warn("close of unknown key", "remote", c.RemoteAddr())
+		reject(c, CodeUnknownKey)
 		return
 	}
-	l.close <- true
-	delete(s.key, key)
-	delete(s.addr, l.Addr)
+	slog.Info("close", "addr", l.Addr)
+	fmt.Fprintln(c, "OK")
+	c.Close()
 }
 
-func (s *Server) Dial(c net.Conn, addr string) {
+func (s *Server) dial(c net.Conn, addr, from string) {
 	s.mu.Lock()
 	l, ok := s.addr[addr]
+	reachable := s.reachable(from, addr)
 	s.mu.Unlock()
 	if !ok {
-		fmt.Fprintln(c, "ERROR unknown address")
+		slog.Warn("dial of unknown address", "remote", c.RemoteAddr(), "addr", addr)
+		reject(c, CodeUnknownAddress)
 		return
 	}
-	l.dial <- c
+	if !reachable {
+		slog.Info("dial across partition", "addr", addr, "from", from)
+		reject(c, CodeUnreachable)
+		return
+	}
+	select {
+	case l.dial <- &call{c: c, from: from}:
+	case <-l.done:
+		reject(c, CodeUnknownAddress)
+	}
 }
 
 // Listener represents an listening TCP socket.
 type Listener struct {
-	Addr   string
-	accept chan chan net.Conn
-	dial   chan net.Conn
-	close  chan bool
+	Addr     string
+	timeout  time.Duration
+	accept   chan chan *call
+	withdraw chan chan *call // accepts whose client went away
+	dial     chan *call
+	close    chan bool
+	done     chan struct{} // closed when the listener is
 }
 
-func NewListener(addr string) *Listener {
+// NewListener returns a Listener for addr whose dialers wait up to timeout
+// to be accepted, or indefinitely if timeout is not positive.
+func NewListener(addr string, timeout time.Duration) *Listener {
 	l := &Listener{
-		Addr:   addr,
-		accept: make(chan chan net.Conn),
-		dial:   make(chan net.Conn),
-		close:  make(chan bool),
+		Addr:     addr,
+		timeout:  timeout,
+		accept:   make(chan chan *call),
+		withdraw: make(chan chan *call),
+		dial:     make(chan *call),
+		close:    make(chan bool),
+		done:     make(chan struct{}),
 	}
 	go l.loop()
 	return l
 }
 
+// next waits for a dialer and returns its call, or an error code if a
+// later ACCEPT takes its place or the listener is closed. If gone is
+// closed first, the accept is withdrawn and next returns neither.
+func (l *Listener) next(gone <-chan struct{}) (*call, string) {
+	// The loop never blocks sending on ch, so that the accept can be
+	// withdrawn at any time.
+	ch := make(chan *call, 1)
+	select {
+	case l.accept <- ch:
+	case <-l.done:
+		return nil, CodeUnknownKey
+	case <-gone:
+		return nil, ""
+	}
+	select {
+	case d := <-ch:
+		if d == nil {
+			return nil, CodeDuplicateAccept
+		}
+		return d, ""
+	case <-l.done:
+		drain(ch)
+		return nil, CodeUnknownKey
+	case <-gone:
+		select {
+		case l.withdraw <- ch:
+		case <-l.done:
+			drain(ch)
+		}
+		return nil, ""
+	}
+}
+
+// drain turns away a dialer handed to an accept of a closed listener.
+func drain(ch chan *call) {
+	select {
+	case d := <-ch:
+		if d != nil {
+			go reject(d.c, CodeUnknownAddress)
+		}
+	default:
+	}
+}
+
+// A call is a dialer waiting to be accepted.
+type call struct {
+	c        net.Conn
+	from     string // the dialer's own address, if it gave one
+	deadline time.Time
+}
+
 func (l *Listener) loop() {
-	var acpt chan net.Conn
-	var dial []net.Conn
+	defer close(l.done)
+	var acpt chan *call
+	var dial []*call // in order of arrival, and so of deadline
+	t := time.NewTimer(time.Hour)
+	t.Stop()
 	for {
+		var expire <-chan time.Time
+		if l.timeout > 0 && len(dial) > 0 {
+			t.Reset(time.Until(dial[0].deadline))
+			expire = t.C
+		}
 		select {
 		case ch := <-l.accept:
 			if acpt != nil {
@@ -198,22 +496,45 @@ func (l *Listener) loop() {
 				dial = dial[1:]
 				acpt = nil
 			}
-		case c := <-l.dial:
+		case ch := <-l.withdraw:
+			if acpt == ch {
+				acpt = nil
+			}
+			select {
+			case d := <-ch:
+				if d != nil {
+					// Handed over before the accept was withdrawn;
+					// the dialer, which arrived before any still
+					// waiting, is first in line again.
+					dial = append([]*call{d}, dial...)
+				}
+			default:
+			}
+		case d := <-l.dial:
+			d.deadline = time.Now().Add(l.timeout)
 			if acpt != nil {
-				acpt <- c
+				acpt <- d
 				acpt = nil
 			} else {
-				dial = append(dial, c)
+				dial = append(dial, d)
 			}
-		case <-l.close:
-			if acpt != nil {
-				acpt <- nil
+		case now := <-expire:
+			for len(dial) > 0 && !dial[0].deadline.After(now) {
+				slog.Info("accept timeout", "addr", l.Addr, "remote", dial[0].c.RemoteAddr())
+				go reject(dial[0].c, CodeTimeout)
+				dial = dial[1:]
 			}
-			for _, c := range dial {
-				c.Close()
+		case <-l.close:
+			for _, d := range dial {
+				go reject(d.c, CodeUnknownAddress)
 			}
 			return
 		}
-
+		if !t.Stop() {
+			select {
+			case <-t.C:
+			default:
+			}
+		}
 	}
 }
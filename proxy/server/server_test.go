@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeClose(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer()
+	errc := make(chan error, 1)
+	go func() { errc <- s.Serve(ln) }()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprintln(c, "LISTEN")
+	var ok, addr, key string
+	if _, err := fmt.Fscan(bufio.NewReader(c), &ok, &addr, &key); err != nil {
+		t.Fatal(err)
+	}
+	if ok != "OK" {
+		t.Errorf("LISTEN answered %v, want OK", ok)
+	}
+	if addr != "10.0.0.1" {
+		t.Errorf("LISTEN gave address %v, want 10.0.0.1", addr)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errc:
+		if err != ErrServerClosed {
+			t.Errorf("Serve returned %v, want ErrServerClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after Close")
+	}
+	if err := s.Serve(ln); err != ErrServerClosed {
+		t.Errorf("Serve after Close returned %v, want ErrServerClosed", err)
+	}
+}
+
+func TestBadCommand(t *testing.T) {
+	defer func(d time.Duration) { commandTimeout = d }(commandTimeout)
+	commandTimeout = 50 * time.Millisecond
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer()
+	defer s.Close()
+	go s.Serve(ln)
+
+	for _, cmd := range []string{
+		"BOGUS\n",
+		"LISTEN nop\n", // from a client of the original protocol
+		"DIAL\n",
+		"ACCEPT a b\n",
+		"DIAL 10.0.0.1\n",
+		"CLOSE nokey\n",
+		"LISTEN",                        // never finished
+		strings.Repeat("x", maxCommand), // too long
+	} {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprint(c, cmd)
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b, err := ioutil.ReadAll(c)
+		c.Close()
+		if err != nil {
+			t.Errorf("%q: %v", cmd, err)
+			continue
+		}
+		if !strings.HasPrefix(string(b), "ERROR ") {
+			t.Errorf("%q answered %q, want an error", cmd, b)
+		}
+	}
+}
+
+func TestWithdrawDeadline(t *testing.T) {
+	const timeout = 300 * time.Millisecond
+	l := NewListener("10.0.0.1", timeout)
+	defer func() { l.close <- true }()
+
+	// The first dialer is handed to an accept that is later withdrawn,
+	// while the second waits behind it.
+	start := time.Now()
+	first, server := net.Pipe()
+	defer first.Close()
+	ch := make(chan *call, 1)
+	l.accept <- ch
+	l.dial <- &call{c: server}
+	second, server := net.Pipe()
+	defer second.Close()
+	l.dial <- &call{c: server}
+	time.Sleep(timeout * 5 / 6)
+	l.withdraw <- ch
+
+	// Both time out as they would have had the accept never been made.
+	for _, c := range []net.Conn{first, second} {
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b, err := bufio.NewReader(c).ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "ERROR " + CodeTimeout + "\n"; b != want {
+			t.Errorf("dialer answered %q, want %q", b, want)
+		}
+	}
+	if el := time.Since(start); el > timeout*3/2 {
+		t.Errorf("dialers timed out after %v, want about %v", el, timeout)
+	}
+}
+
+func TestListenerClose(t *testing.T) {
+	l := NewListener("10.0.0.1", -1)
+	dialer, server := net.Pipe()
+	defer dialer.Close()
+	l.dial <- &call{c: server}
+	l.close <- true
+	b, err := bufio.NewReader(dialer).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "ERROR " + CodeUnknownAddress + "\n"; b != want {
+		t.Errorf("queued dialer answered %q, want %q", b, want)
+	}
+	if d, code := l.next(nil); d != nil || code != CodeUnknownKey {
+		t.Errorf("next after close = %v, %q; want nil, %q", d, code, CodeUnknownKey)
+	}
+}
@@ -0,0 +1,179 @@
+package util
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// TLSConfig returns a TLS configuration for a whispernet node, for use both
+// when listening and when dialling.
+//
+// The node's certificate and key are read from cert.pem and key.pem in dir.
+// If they don't exist, a self-signed leaf certificate and its key are
+// generated and saved there.
+//
+// If caDir is empty, connections are encrypted but peers are not
+// authenticated. Otherwise both sides of every connection must present a
+// certificate issued by one of the CA certificates (*.pem or *.crt) in
+// caDir, so each node's cert.pem and key.pem must be issued by such a CA
+// rather than generated, and TLSConfig fails if they don't exist.
+func TLSConfig(dir, caDir string) (*tls.Config, error) {
+	if caDir != "" {
+		if _, err := os.Stat(filepath.Join(dir, "cert.pem")); os.IsNotExist(err) {
+			return nil, fmt.Errorf("no certificate in %v: peers are authenticated against %v, so this node needs a certificate issued by a CA there", dir, caDir)
+		}
+	}
+	cert, err := loadOrCreateCert(dir)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		// Peers are addressed by IP and their certificates name no host,
+		// so standard verification can't be used; see below.
+		InsecureSkipVerify: true,
+		ClientAuth:         tls.RequestClientCert,
+	}
+	if caDir == "" {
+		return config, nil
+	}
+	pool, err := loadCerts(caDir)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientAuth = tls.RequireAnyClientCert
+	config.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+		return verifyChain(raw, pool)
+	}
+	return config, nil
+}
+
+// ListenTLS is like Listen, but connections accepted by the returned
+// Listener use TLS with the given configuration.
+func ListenTLS(config *tls.Config) (net.Listener, error) {
+	l, err := Listen()
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, config), nil
+}
+
+// DialTLS connects to the given address using TLS with the given
+// configuration, giving up when ctx is done.
+func DialTLS(ctx context.Context, addr string, config *tls.Config) (net.Conn, error) {
+	d := tls.Dialer{Config: config}
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// verifyChain checks that the first certificate in raw was issued by a
+// certificate in roots, ignoring host names.
+func verifyChain(raw [][]byte, roots *x509.CertPool) error {
+	if len(raw) == 0 {
+		return errors.New("peer presented no certificate")
+	}
+	certs := make([]*x509.Certificate, len(raw))
+	for i, b := range raw {
+		c, err := x509.ParseCertificate(b)
+		if err != nil {
+			return err
+		}
+		certs[i] = c
+	}
+	inter := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		inter.AddCert(c)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: inter,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+func loadOrCreateCert(dir string) (tls.Certificate, error) {
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err == nil || !os.IsNotExist(err) {
+		return cert, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return cert, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return cert, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "whispernet node " + RandomID()},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return cert, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return cert, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return cert, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		return cert, err
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return cert, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+func loadCerts(dir string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	var files []string
+	for _, pat := range []string{"*.pem", "*.crt"} {
+		m, err := filepath.Glob(filepath.Join(dir, pat))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, m...)
+	}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("%v: no certificates found", f)
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no certificates found in %v", dir)
+	}
+	return pool, nil
+}
@@ -0,0 +1,168 @@
+package util
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// roundTrip dials a TLS listener using the given configurations and
+// reports the error seen by the dialler, if any.
+func roundTrip(t *testing.T, server, client *tls.Config) error {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l = tls.NewListener(l, server)
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	c, err := DialTLS(context.Background(), l.Addr().String(), client)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("x")); err != nil {
+		return err
+	}
+	_, err = c.Read(make([]byte, 1))
+	return err
+}
+
+// writeCert creates a certificate for key issued by parent, or self-signed
+// if parent is nil, and writes it to cert.pem in dir, and key to key.pem.
+func writeCert(t *testing.T, dir string, tmpl, parent *x509.Certificate, key, parentKey *ecdsa.PrivateKey) *x509.Certificate {
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "cert.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "util-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a, b, ca := filepath.Join(dir, "a"), filepath.Join(dir, "b"), filepath.Join(dir, "ca")
+
+	// Generated on first use, and reused afterwards.
+	ca1, err := TLSConfig(a, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca2, err := TLSConfig(a, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ca1.Certificates[0].Certificate[0]) != string(ca2.Certificates[0].Certificate[0]) {
+		t.Error("certificate not persisted")
+	}
+	cb, err := TLSConfig(b, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := roundTrip(t, ca1, cb); err != nil {
+		t.Errorf("unauthenticated TLS: %v", err)
+	}
+
+	// The generated certificates can't issue others.
+	leaf, err := x509.ParseCertificate(ca1.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.IsCA || leaf.KeyUsage&x509.KeyUsageCertSign != 0 {
+		t.Error("generated certificate is a CA")
+	}
+
+	// Only a has a certificate issued by the CA.
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert := writeCert(t, ca, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil, caKey, nil)
+	if err := os.Remove(filepath.Join(ca, "key.pem")); err != nil { // not a certificate
+		t.Fatal(err)
+	}
+	aKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCert(t, a, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "a"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}, caCert, aKey, caKey)
+	if _, err := TLSConfig(filepath.Join(dir, "c"), ca); err == nil {
+		t.Error("certificate generated for a node that needs one issued by a CA")
+	}
+	mutualA, err := TLSConfig(a, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutualB, err := TLSConfig(b, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := roundTrip(t, mutualA, mutualA); err != nil {
+		t.Errorf("trusted peer rejected: %v", err)
+	}
+	if err := roundTrip(t, mutualA, mutualB); err == nil {
+		t.Error("untrusted client accepted")
+	}
+	if err := roundTrip(t, mutualB, mutualA); err == nil {
+		t.Error("untrusted server accepted")
+	}
+}
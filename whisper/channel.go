@@ -0,0 +1,52 @@
+package whisper
+
+import "sort"
+
+// Messages may be posted to a named channel. Every node relays messages
+// on all channels, so that the mesh stays connected, but delivers to its
+// subscribers only those on channels it has joined. Messages without a
+// channel are always delivered.
+
+// Join subscribes the node to the named channel.
+func (n *Node) Join(channel string) {
+	n.mu.Lock()
+	n.channels[channel] = true
+	n.mu.Unlock()
+}
+
+// Part unsubscribes the node from the named channel.
+func (n *Node) Part(channel string) {
+	n.mu.Lock()
+	delete(n.channels, channel)
+	n.mu.Unlock()
+}
+
+// Channels returns the names of the channels the node has joined.
+func (n *Node) Channels() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	l := make([]string, 0, len(n.channels))
+	for ch := range n.channels {
+		l = append(l, ch)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// SendChannel broadcasts a new message with the given body on the named
+// channel and returns it.
+func (n *Node) SendChannel(channel, body string) Message {
+	m := n.newMessage(body, n.TTL)
+	m.Channel = channel
+	return n.send(m)
+}
+
+// joined reports whether messages on the named channel should be delivered.
+func (n *Node) joined(channel string) bool {
+	if channel == "" {
+		return true
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.channels[channel]
+}
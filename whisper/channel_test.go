@@ -0,0 +1,52 @@
+package whisper
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChannels(t *testing.T) {
+	// a -> b -> c; b relays #gophers without joining it.
+	a, b, c := newTestNode(t), newTestNode(t), newTestNode(t)
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+	a.MaxPeers, c.MaxPeers = 1, 1
+	c.Join("gophers")
+	c.Join("rust")
+	c.Part("rust")
+	if got, want := c.Channels(), []string{"gophers"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Channels() = %q, want %q", got, want)
+	}
+	chB, cancel := b.Subscribe()
+	defer cancel()
+	chC, cancel := c.Subscribe()
+	defer cancel()
+	b.Start(context.Background())
+	a.Start(context.Background(), b.Addr())
+	c.Start(context.Background(), b.Addr())
+
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		a.SendChannel("gophers", "hello gophers")
+		select {
+		case m := <-chC:
+			done = m.Channel == "gophers" && m.Body == "hello gophers"
+		case <-time.After(50 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("channel message not relayed")
+		}
+	}
+	for {
+		select {
+		case m := <-chB:
+			if m.Channel != "" {
+				t.Fatalf("node received message on unjoined channel: %+v", m)
+			}
+		default:
+			return
+		}
+	}
+}
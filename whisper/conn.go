@@ -0,0 +1,578 @@
+package whisper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"code.google.com/p/whispering-gophers/util"
+)
+
+// A connection between two nodes is full-duplex: the dialling node sends a
+// hello naming its listen address, the accepting node replies with its own
+// hello and registers the connection under that address, and from then on
+// both sides send and receive envelopes on it.
+//
+// Peers that predate the handshake send bare messages on connections they
+// dial and never reply to a hello; such connections are used in one
+// direction only. A dialling node that gets no reply within
+// handshakeTimeout sends bare messages until the reply arrives, if it ever
+// does, so that a slow peer is treated as an old one only for a while.
+
+// serve handles a connection accepted from a peer.
+func (n *Node) serve(c net.Conn) {
+	c = n.trace(c)
+	defer c.Close()
+	n.logger().Info("accepted connection", "dir", "in", "remote", c.RemoteAddr())
+	defer n.logger().Info("closed connection", "dir", "in", "remote", c.RemoteAddr())
+
+	// Until the connection becomes a session, which drains its queue
+	// before closing, shutting down closes it immediately.
+	stop := context.AfterFunc(n.ctx, func() { c.Close() })
+	defer stop()
+
+	d := json.NewDecoder(c)
+	e := json.NewEncoder(c)
+	var f frame
+	if err := d.Decode(&f); err != nil {
+		if n.ctx.Err() == nil {
+			n.logger().Warn("receive error", "dir", "in", "remote", c.RemoteAddr(), "err", err)
+		}
+		return
+	}
+	if f.legacy() || f.Type != TypeHello {
+		// A peer that predates the handshake.
+		err := n.handle(c, &f, "")
+		if err == nil {
+			err = n.receive(c, d, "")
+		}
+		n.logRecvError(c, err)
+		return
+	}
+	if err := f.CheckVersion(); err != nil {
+		n.logger().Warn("rejected peer", "dir", "in", "remote", c.RemoteAddr(), "err", err)
+		if env, err := NewEnvelope(TypeError, err.Error()); err == nil {
+			e.Encode(env)
+		}
+		return
+	}
+	var h Hello
+	f.Decode(&h)
+	n.learnHello(h)
+	env, err := NewEnvelope(TypeHello, n.hello())
+	if err == nil {
+		err = e.Encode(env)
+	}
+	if err != nil {
+		n.logger().Warn("receive error", "dir", "in", "remote", c.RemoteAddr(), "err", err)
+		return
+	}
+
+	var q *Peer
+	if h.Addr != "" && h.Addr != n.self {
+		n.known.add(h.Addr)
+		q = n.peers.Add(h.Addr, n.queueSize(), 0)
+	}
+	if q == nil {
+		// We already have a connection to this peer (perhaps both sides
+		// dialled at once), so only listen on this one.
+		n.logRecvError(c, n.receive(c, d, h.Addr))
+		return
+	}
+	defer n.remove(q)
+	defer n.redial.forget(h.Addr)
+	n.redial.connected(h.Addr, true)
+	n.logger().Info("peer connected", "dir", "in", "remote", c.RemoteAddr(), "peer", h.Addr)
+
+	if !stop() {
+		return // Shutting down.
+	}
+	n.session(c, d, e, q, nil)
+}
+
+// dial connects to the peer at addr and exchanges messages with it,
+// reconnecting with backoff if the connection fails.
+// If max is positive, it does nothing if the node already has max peers.
+func (n *Node) dial(addr string, max int) {
+	if addr == "" || addr == n.self {
+		return // Don't try to dial self.
+	}
+	if n.ctx.Err() != nil {
+		return // Shutting down.
+	}
+	if !n.redial.alive(addr, time.Now()) {
+		return // Peer recently declared dead.
+	}
+
+	q := n.peers.Add(addr, n.queueSize(), max)
+	if q == nil {
+		return // Peer already connected, or enough peers.
+	}
+	defer n.remove(q)
+	defer n.redial.forget(addr)
+
+	b := n.Backoff.withDefaults()
+	for {
+		err := n.connect(q)
+		if n.ctx.Err() != nil {
+			return
+		}
+		d, ok := n.redial.failed(addr, err, b, time.Now())
+		if !ok {
+			n.logger().Warn("giving up on peer", "dir", "out", "peer", addr, "cooldown", b.Cooldown)
+			return
+		}
+		n.logger().Info("reconnecting", "dir", "out", "peer", addr, "delay", d)
+		select {
+		case <-time.After(d):
+		case <-n.ctx.Done():
+			return
+		}
+	}
+}
+
+func (n *Node) queueSize() int {
+	if n.QueueSize > 0 {
+		return n.QueueSize
+	}
+	return DefaultQueueSize
+}
+
+// connect makes a single connection to the peer and exchanges messages
+// with it until the connection fails or the node shuts down.
+func (n *Node) connect(q *Peer) error {
+	addr := q.Addr
+	n.logger().Debug("dialling", "dir", "out", "peer", addr)
+	dial := n.Dial
+	if dial == nil {
+		dial = func(ctx context.Context, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+		}
+	}
+	c, err := dial(n.ctx, addr)
+	if err != nil {
+		atomic.AddUint64(&n.stats.dialFailures, 1)
+		n.logger().Warn("dial error", "dir", "out", "peer", addr, "err", err)
+		return err
+	}
+	c = n.trace(c)
+	defer func() {
+		c.Close()
+		n.logger().Info("closed connection", "dir", "out", "peer", addr)
+	}()
+	e := json.NewEncoder(c)
+	d, hello, err := n.handshake(c, e)
+	if err != nil {
+		atomic.AddUint64(&n.stats.dialFailures, 1)
+		n.logger().Warn("handshake error", "dir", "out", "peer", addr, "err", err)
+		return err
+	}
+	n.redial.connected(addr, false)
+	n.logger().Info("peer connected", "dir", "out", "peer", addr)
+	return n.session(c, d, e, q, hello)
+}
+
+// session sends the messages queued in q to the peer on c while receiving
+// from it, until the connection fails or the node shuts down.
+// If hello is not nil, the peer has yet to answer the handshake and is
+// treated as predating envelopes until hello delivers a nil error.
+func (n *Node) session(c net.Conn, d *json.Decoder, e *json.Encoder, q *Peer, hello <-chan error) error {
+	errc := make(chan error, 1)
+	var upgrade chan struct{}
+	if hello != nil {
+		upgrade = make(chan struct{})
+	}
+	n.goFunc(func() {
+		if hello != nil {
+			if err := <-hello; err != nil {
+				errc <- err
+				return
+			}
+			close(upgrade)
+		}
+		errc <- n.receive(c, d, q.Addr)
+	})
+	err := n.transmit(c, e, q, hello != nil, upgrade, errc)
+	c.Close()
+	if err != nil {
+		n.logger().Warn("connection error", "peer", q.Addr, "err", err)
+	}
+	return err
+}
+
+// transmit writes messages from q to c until the connection fails, the
+// receiving side reports an error on errc, or the node shuts down.
+// If legacy is set, it sends bare messages until upgrade is closed.
+func (n *Node) transmit(c net.Conn, e *json.Encoder, q *Peer, legacy bool, upgrade <-chan struct{}, errc <-chan error) error {
+	ps := n.stats.peer(q.Addr)
+	send := func(m Message) error {
+		var v interface{} = m
+		if !legacy {
+			env, err := NewEnvelope(TypeMessage, m)
+			if err != nil {
+				return err
+			}
+			env.TTL = m.TTL
+			v = env
+		}
+		if err := e.Encode(v); err != nil {
+			return err
+		}
+		atomic.AddUint64(&ps.sent, 1)
+		return nil
+	}
+
+	// Don't let a slow peer hold up shutdown.
+	stop := context.AfterFunc(n.ctx, func() {
+		c.SetWriteDeadline(time.Now().Add(drainTimeout))
+	})
+	defer stop()
+
+	// Forget slowness from a previous connection.
+	select {
+	case <-q.slow:
+	default:
+	}
+
+	pex := time.NewTicker(n.pexInterval())
+	defer pex.Stop()
+	var digest <-chan time.Time
+	var digestTicker *time.Ticker
+	defer func() {
+		if digestTicker != nil {
+			digestTicker.Stop()
+		}
+	}()
+	// begin starts the traffic that only peers speaking envelopes expect.
+	begin := func() error {
+		if d := n.antiEntropyInterval(); d > 0 {
+			digestTicker = time.NewTicker(d)
+			digest = digestTicker.C
+		}
+		if err := n.sendPeers(e); err != nil {
+			return err
+		}
+		return n.requestHistory(e)
+	}
+	if !legacy {
+		if err := begin(); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-pex.C:
+			if legacy {
+				continue
+			}
+			if err := n.sendPeers(e); err != nil {
+				return err
+			}
+		case <-upgrade:
+			n.logger().Info("peer answered hello late", "dir", "out", "peer", q.Addr)
+			upgrade, legacy = nil, false
+			if err := begin(); err != nil {
+				return err
+			}
+		case <-digest:
+			if err := n.sendDigest(e); err != nil {
+				return err
+			}
+		case m := <-q.ch:
+			if err := send(m); err != nil {
+				return err
+			}
+		case env := <-q.ctl:
+			if err := e.Encode(env); err != nil {
+				return err
+			}
+		case <-q.slow:
+			n.logger().Warn("disconnecting slow peer", "peer", q.Addr)
+			return errSlowPeer
+		case err := <-errc:
+			if err == nil {
+				err = errors.New("connection closed by peer")
+			}
+			return err
+		case <-n.ctx.Done():
+			n.drain(send, q.ch)
+			return nil
+		}
+	}
+}
+
+var errSlowPeer = errors.New("peer too slow")
+
+// receive reads envelopes from c until the connection fails.
+// from is the address of the peer, if known.
+func (n *Node) receive(c net.Conn, d *json.Decoder, from string) error {
+	for {
+		var f frame
+		if err := d.Decode(&f); err != nil {
+			if n.ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if err := n.handle(c, &f, from); err != nil {
+			return err
+		}
+	}
+}
+
+// handle processes an envelope or bare message received on c.
+func (n *Node) handle(c net.Conn, f *frame, from string) error {
+	if f.legacy() {
+		n.deliver(c, f.message(), from)
+		return nil
+	}
+	if err := f.CheckVersion(); err != nil {
+		return err
+	}
+	switch f.Type {
+	case TypePeers:
+		var pl PeerList
+		if err := f.Decode(&pl); err != nil {
+			n.logger().Warn("bad peer list", "dir", "in", "remote", c.RemoteAddr(), "err", err)
+			return nil
+		}
+		n.learn(pl.Addrs...)
+	case TypeMessage:
+		var m Message
+		if err := f.Decode(&m); err != nil {
+			n.logger().Warn("bad message", "dir", "in", "remote", c.RemoteAddr(), "err", err)
+			return nil
+		}
+		m.TTL = f.TTL
+		n.deliver(c, m, from)
+	case TypeHistoryRequest:
+		var req HistoryRequest
+		if err := f.Decode(&req); err != nil {
+			n.logger().Warn("bad history request", "dir", "in", "remote", c.RemoteAddr(), "err", err)
+			return nil
+		}
+		n.answerHistory(c, req, from)
+	case TypeHistory:
+		var l []Message
+		if err := f.Decode(&l); err != nil {
+			n.logger().Warn("bad history", "dir", "in", "remote", c.RemoteAddr(), "err", err)
+			return nil
+		}
+		n.logger().Info("replaying history", "dir", "in", "remote", c.RemoteAddr(), "count", len(l))
+		for _, m := range l {
+			n.take(c, m, from)
+		}
+	case TypeDigest:
+		var dg Digest
+		if err := f.Decode(&dg); err != nil {
+			n.logger().Warn("bad digest", "dir", "in", "remote", c.RemoteAddr(), "err", err)
+			return nil
+		}
+		n.want(c, dg, from)
+	case TypeWant:
+		var dg Digest
+		if err := f.Decode(&dg); err != nil {
+			n.logger().Warn("bad want", "dir", "in", "remote", c.RemoteAddr(), "err", err)
+			return nil
+		}
+		n.resend(dg, from)
+	case TypeReport:
+		var r Report
+		if err := f.Decode(&r); err != nil {
+			n.logger().Warn("bad topology report", "dir", "in", "remote", c.RemoteAddr(), "err", err)
+			return nil
+		}
+		n.relayReport(r, from)
+	case TypeError:
+		var msg string
+		f.Decode(&msg)
+		return fmt.Errorf("error from peer: %v", msg)
+	}
+	// Other types were added by a newer minor version; ignore them.
+	return nil
+}
+
+// deliver hands a message received from a peer to subscribers and relays it
+// to the other peers, unless it has been seen before or fails verification.
+func (n *Node) deliver(c net.Conn, m Message, from string) {
+	if !n.take(c, m, from) {
+		return
+	}
+	if m, ok := n.hop(m); ok {
+		n.recent.add(m, time.Now())
+		n.broadcast(m, from)
+	}
+	n.learn(m.Addr)
+}
+
+// take records a message received on c from the peer at address from, if
+// known, and hands it to subscribers. It reports false if the message has
+// been seen before or fails verification.
+func (n *Node) take(c net.Conn, m Message, from string) bool {
+	ps := n.stats.peer(from)
+	atomic.AddUint64(&ps.received, 1)
+	// Verify before marking the ID seen, so that a forgery can't
+	// suppress the genuine message.
+	if err := n.verify(m); err != nil {
+		n.logger().Warn("dropped message", "dir", "in", "remote", c.RemoteAddr(), "id", m.ID, "err", err)
+		return false
+	}
+	if n.Seen(m.ID) {
+		atomic.AddUint64(&ps.duplicate, 1)
+		return false
+	}
+	n.logger().Debug("received message", "dir", "in", "remote", c.RemoteAddr(), "id", m.ID, "origin", m.Addr, "clock", m.Clock, "body", m.Body)
+	n.observe(m)
+	n.record(m)
+	if m.Sig != "" && m.Addr != "" && !n.keys.set(m.Addr, m.Key) {
+		n.logger().Warn("message signed with a new key for its address", "dir", "in", "remote", c.RemoteAddr(), "id", m.ID, "origin", m.Addr, "key", m.Key)
+	}
+	switch {
+	case m.To == "":
+		if n.joined(m.Channel) {
+			n.publish(m)
+		}
+	case n.Identity != nil && m.To == n.Identity.String():
+		if dm, err := n.open(m); err != nil {
+			n.logger().Warn("bad direct message", "dir", "in", "remote", c.RemoteAddr(), "id", m.ID, "err", err)
+		} else {
+			n.publish(dm)
+		}
+	}
+	return true
+}
+
+func (n *Node) logRecvError(c net.Conn, err error) {
+	if err != nil {
+		n.logger().Warn("receive error", "dir", "in", "remote", c.RemoteAddr(), "err", err)
+	}
+}
+
+// sendPeers sends a peer exchange envelope.
+func (n *Node) sendPeers(e *json.Encoder) error {
+	env, err := NewEnvelope(TypePeers, n.peerSample())
+	if err != nil {
+		return err
+	}
+	return e.Encode(env)
+}
+
+// handshake sends a hello envelope on c and waits for the peer's reply.
+// It returns the decoder to continue reading the connection with. If the
+// peer does not reply within handshakeTimeout, it may predate envelopes;
+// handshake then returns a channel on which the outcome is delivered if the
+// reply comes later.
+func (n *Node) handshake(c net.Conn, e *json.Encoder) (d *json.Decoder, hello <-chan error, err error) {
+	env, err := NewEnvelope(TypeHello, n.hello())
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := e.Encode(helloEnvelope{env, util.RandomID(), n.self}); err != nil {
+		return nil, nil, err
+	}
+	d = json.NewDecoder(c)
+	ch := make(chan error, 1)
+	n.goFunc(func() { ch <- n.readHello(d) })
+	t := time.NewTimer(handshakeTimeout)
+	defer t.Stop()
+	select {
+	case err := <-ch:
+		if err != nil {
+			return nil, nil, err
+		}
+		return d, nil, nil
+	case <-t.C:
+		return d, ch, nil
+	}
+}
+
+// readHello reads the peer's reply to a hello from d.
+func (n *Node) readHello(d *json.Decoder) error {
+	var reply Envelope
+	if err := d.Decode(&reply); err != nil {
+		return err
+	}
+	if err := reply.CheckVersion(); err != nil {
+		return err
+	}
+	switch reply.Type {
+	case TypeHello:
+		var h Hello
+		reply.Decode(&h)
+		n.learnHello(h)
+		return nil
+	case TypeError:
+		var msg string
+		reply.Decode(&msg)
+		return fmt.Errorf("rejected by peer: %v", msg)
+	}
+	return fmt.Errorf("unexpected %q envelope in handshake", reply.Type)
+}
+
+// hello returns the node's handshake payload.
+func (n *Node) hello() Hello {
+	h := Hello{Addr: n.self}
+	if n.Identity != nil {
+		n.Identity.signHello(&h)
+	}
+	return h
+}
+
+// learnHello records the public key in a peer's handshake.
+func (n *Node) learnHello(h Hello) {
+	if h.Sig != "" && h.Addr != "" && verifyHello(h) && !n.keys.set(h.Addr, h.Key) {
+		n.logger().Warn("hello signed with a new key for its address", "peer", h.Addr, "key", h.Key)
+	}
+}
+
+// handshakeTimeout is how long to wait for a peer to answer a hello before
+// sending it bare messages.
+var handshakeTimeout = time.Second
+
+// drain sends any messages still pending on ch.
+func (n *Node) drain(send func(Message) error, ch <-chan Message) {
+	for {
+		select {
+		case m := <-ch:
+			if err := send(m); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// drainTimeout bounds how long a shutting-down node waits on a slow peer.
+const drainTimeout = time.Second
+
+// trace returns c, wrapped to log its traffic if n.Trace is set.
+func (n *Node) trace(c net.Conn) net.Conn {
+	if !n.Trace {
+		return c
+	}
+	return traceConn{c, n.logger().With("remote", c.RemoteAddr())}
+}
+
+type traceConn struct {
+	net.Conn
+	log *slog.Logger
+}
+
+func (c traceConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	c.log.Info("wire", "dir", "out", "data", string(b[:n]), "err", err)
+	return
+}
+
+func (c traceConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	c.log.Info("wire", "dir", "in", "data", string(b[:n]), "err", err)
+	return
+}
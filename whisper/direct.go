@@ -0,0 +1,200 @@
+package whisper
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+)
+
+// Direct messages are flooded like any other message, but their Body is
+// encrypted to the recipient named by their To field, the public key of
+// the recipient's Identity.
+//
+// The sender generates an ephemeral X25519 key pair and combines it with
+// the X25519 form of the recipient's ed25519 key. The shared secret keys
+// AES-256-GCM, and the Body holds the ephemeral public key, nonce and
+// ciphertext, base64 encoded.
+
+// Errors returned by SendDirect.
+var (
+	ErrNoIdentity       = errors.New("node has no identity")
+	ErrUnknownRecipient = errors.New("no public key known for recipient")
+)
+
+// directory maps node addresses to the public keys they have signed with,
+// as learned from signed messages and handshakes.
+//
+// A valid signature proves only that the sender holds the key, not that it
+// owns the address it claims, so the first key seen for an address is
+// trusted and never replaced.
+type directory struct {
+	mu sync.Mutex
+	m  map[string]string
+}
+
+// set records key for addr, unless another key is already recorded for it.
+// It reports whether key is the one recorded.
+func (d *directory) set(addr, key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if old, ok := d.m[addr]; ok {
+		return old == key
+	}
+	d.m[addr] = key
+	return true
+}
+
+func (d *directory) get(addr string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.m[addr]
+}
+
+// SendDirect broadcasts a message whose body only the node at addr can
+// read. The recipient's public key must have been learned from a signed
+// message or handshake from that node.
+func (n *Node) SendDirect(addr, body string) (Message, error) {
+	return n.sendDirect(addr, body, "")
+}
+
+func (n *Node) sendDirect(addr, body, replyTo string) (Message, error) {
+	if n.Identity == nil {
+		return Message{}, ErrNoIdentity
+	}
+	to := n.keys.get(addr)
+	if to == "" {
+		return Message{}, ErrUnknownRecipient
+	}
+	sealed, err := seal(to, []byte(body))
+	if err != nil {
+		return Message{}, err
+	}
+	m := n.newMessage(sealed, n.TTL)
+	m.To = to
+	m.ReplyTo = replyTo
+	return n.send(m), nil
+}
+
+// open decrypts a direct message addressed to the node.
+func (n *Node) open(m Message) (Message, error) {
+	if n.Identity == nil || m.To != n.Identity.String() {
+		return m, errors.New("not addressed to this node")
+	}
+	h := sha512.Sum512(n.Identity.private.Seed())
+	priv, err := ecdh.X25519().NewPrivateKey(h[:32])
+	if err != nil {
+		return m, err
+	}
+	b, err := base64.StdEncoding.DecodeString(m.Body)
+	if err != nil || len(b) < 32 {
+		return m, errors.New("malformed direct message")
+	}
+	eph, err := ecdh.X25519().NewPublicKey(b[:32])
+	if err != nil {
+		return m, err
+	}
+	secret, err := priv.ECDH(eph)
+	if err != nil {
+		return m, err
+	}
+	aead, err := directAEAD(secret, eph, priv.PublicKey())
+	if err != nil {
+		return m, err
+	}
+	b = b[32:]
+	if len(b) < aead.NonceSize() {
+		return m, errors.New("malformed direct message")
+	}
+	plain, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], nil)
+	if err != nil {
+		return m, err
+	}
+	m.Body = string(plain)
+	return m, nil
+}
+
+// seal encrypts plain to the holder of the given public key.
+func seal(to string, plain []byte) (string, error) {
+	pub, err := ParseKey(to)
+	if err != nil {
+		return "", err
+	}
+	rpub, err := x25519Public(pub)
+	if err != nil {
+		return "", err
+	}
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	secret, err := eph.ECDH(rpub)
+	if err != nil {
+		return "", err
+	}
+	aead, err := directAEAD(secret, eph.PublicKey(), rpub)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	b := append(eph.PublicKey().Bytes(), nonce...)
+	b = aead.Seal(b, nonce, plain, nil)
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// directAEAD returns the cipher for a message with the given shared secret,
+// sent with the ephemeral key eph to the recipient key to.
+func directAEAD(secret []byte, eph, to *ecdh.PublicKey) (cipher.AEAD, error) {
+	h := sha256.New()
+	h.Write(secret)
+	h.Write(eph.Bytes())
+	h.Write(to.Bytes())
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// x25519Public converts an ed25519 public key to the X25519 public key of
+// the same secret, using the birational map u = (1+y)/(1-y) mod 2²⁵⁵-19.
+func x25519Public(pub ed25519.PublicKey) (*ecdh.PublicKey, error) {
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("bad public key length %d", len(pub))
+	}
+	p := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	// The key is y in little-endian order, with the sign of x in the top bit.
+	be := make([]byte, 32)
+	for i, b := range pub {
+		be[31-i] = b
+	}
+	be[0] &= 0x7f
+	y := new(big.Int).SetBytes(be)
+
+	num := new(big.Int).Add(big.NewInt(1), y)
+	den := new(big.Int).Sub(big.NewInt(1), y)
+	den.Mod(den, p)
+	if den.Sign() == 0 {
+		return nil, errors.New("invalid public key")
+	}
+	u := num.Mul(num, den.ModInverse(den, p))
+	u.Mod(u, p)
+
+	out := make([]byte, 32)
+	ub := u.Bytes()
+	for i, b := range ub {
+		out[len(ub)-1-i] = b
+	}
+	return ecdh.X25519().NewPublicKey(out)
+}
@@ -0,0 +1,123 @@
+package whisper
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/sha512"
+	"testing"
+	"time"
+)
+
+func TestX25519Public(t *testing.T) {
+	id, _ := NewIdentity()
+	h := sha512.Sum512(id.private.Seed())
+	priv, err := ecdh.X25519().NewPrivateKey(h[:32])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x25519Public(id.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pub.Equal(priv.PublicKey()) {
+		t.Error("converted public key does not match private key")
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	n := newTestNode(t)
+	defer n.Close()
+	n.Identity, _ = NewIdentity()
+	body, err := seal(n.Identity.String(), []byte("psst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := n.open(Message{To: n.Identity.String(), Body: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Body != "psst" {
+		t.Errorf("opened %q, want %q", m.Body, "psst")
+	}
+
+	other := newTestNode(t)
+	defer other.Close()
+	other.Identity, _ = NewIdentity()
+	if _, err := other.open(Message{To: other.Identity.String(), Body: body}); err == nil {
+		t.Error("message opened by wrong recipient")
+	}
+}
+
+func TestSendDirect(t *testing.T) {
+	// a -> b -> c; only c may read what a sends it.
+	a, b, c := newTestNode(t), newTestNode(t), newTestNode(t)
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+	for _, n := range []*Node{a, b, c} {
+		n.Identity, _ = NewIdentity()
+	}
+	a.MaxPeers, c.MaxPeers = 1, 1
+	chA, cancel := a.Subscribe()
+	defer cancel()
+	chB, cancel := b.Subscribe()
+	defer cancel()
+	chC, cancel := c.Subscribe()
+	defer cancel()
+	b.Start(context.Background())
+	a.Start(context.Background(), b.Addr())
+	c.Start(context.Background(), b.Addr())
+
+	if _, err := a.SendDirect(c.Addr(), "psst"); err != ErrUnknownRecipient {
+		t.Fatalf("SendDirect to unknown node: got %v, want %v", err, ErrUnknownRecipient)
+	}
+	// a learns c's key from a signed message.
+	sendUntil(t, c, chA, "hi")
+
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		sent, err := a.SendDirect(c.Addr(), "psst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sent.Body == "psst" {
+			t.Fatal("direct message sent in plaintext")
+		}
+		select {
+		case m := <-chC:
+			if m.Body != "psst" || m.To != c.Identity.String() {
+				continue
+			}
+			done = true
+		case <-time.After(50 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("direct message not delivered")
+		}
+	}
+	for {
+		select {
+		case m := <-chB:
+			if m.To != "" {
+				t.Fatalf("relaying node received direct message %+v", m)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func TestDirectoryFirstKey(t *testing.T) {
+	d := directory{m: make(map[string]string)}
+	if !d.set("a", "k1") {
+		t.Error("first key for a rejected")
+	}
+	if d.set("a", "k2") {
+		t.Error("second key for a accepted")
+	}
+	if !d.set("a", "k1") {
+		t.Error("repeated first key for a rejected")
+	}
+	if got := d.get("a"); got != "k1" {
+		t.Errorf("key for a = %q, want k1", got)
+	}
+}
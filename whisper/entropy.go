@@ -0,0 +1,148 @@
+package whisper
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+)
+
+// Broadcasting drops messages for peers whose queues are full, so gossip
+// alone does not guarantee delivery. To recover, each node periodically
+// sends each neighbour a digest of the IDs of the messages it has recently
+// sent or relayed. The neighbour replies with the IDs it has not seen,
+// and the node queues those messages for it again.
+
+// Defaults for anti-entropy.
+const (
+	DefaultAntiEntropyInterval = 10 * time.Second
+	recentWindow               = time.Minute // how long messages stay in digests
+	recentMax                  = 1024        // most messages in a digest
+)
+
+// Digest is the payload of TypeDigest and TypeWant envelopes: a list of
+// message IDs.
+type Digest struct {
+	IDs []string
+}
+
+// recent holds the messages a node has recently sent or relayed, as they
+// were queued for its peers, so that they can be sent again on request.
+type recent struct {
+	mu  sync.Mutex
+	m   map[string]recentEntry
+	ids []string // oldest first
+}
+
+type recentEntry struct {
+	m    Message
+	time time.Time
+}
+
+func (r *recent) add(m Message, now time.Time) {
+	if m.ID == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.m[m.ID]; ok {
+		return
+	}
+	r.m[m.ID] = recentEntry{m, now}
+	r.ids = append(r.ids, m.ID)
+	r.expire(now)
+}
+
+// expire forgets messages that are too old or too many.
+// r.mu must be held.
+func (r *recent) expire(now time.Time) {
+	i := 0
+	for ; i < len(r.ids); i++ {
+		if len(r.ids)-i <= recentMax && now.Sub(r.m[r.ids[i]].time) <= recentWindow {
+			break
+		}
+		delete(r.m, r.ids[i])
+	}
+	r.ids = append(r.ids[:0], r.ids[i:]...)
+}
+
+func (r *recent) digest(now time.Time) Digest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire(now)
+	return Digest{IDs: append([]string(nil), r.ids...)}
+}
+
+func (r *recent) get(id string) (Message, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.m[id]
+	return e.m, ok
+}
+
+func (n *Node) antiEntropyInterval() time.Duration {
+	if n.DisableDedup {
+		return -1 // Every message would seem to be missing.
+	}
+	if n.AntiEntropyInterval != 0 {
+		return n.AntiEntropyInterval
+	}
+	return DefaultAntiEntropyInterval
+}
+
+// sendDigest sends a digest of the node's recent messages, if it has any.
+func (n *Node) sendDigest(e *json.Encoder) error {
+	dg := n.recent.digest(time.Now())
+	if len(dg.IDs) == 0 {
+		return nil
+	}
+	env, err := NewEnvelope(TypeDigest, dg)
+	if err != nil {
+		return err
+	}
+	return e.Encode(env)
+}
+
+// want asks the peer at addr, which sent the digest dg on c, for the
+// messages in it that the node has not seen.
+func (n *Node) want(c net.Conn, dg Digest, addr string) {
+	if n.DisableDedup {
+		return
+	}
+	var missing Digest
+	for _, id := range dg.IDs {
+		if !n.SeenIDs.Has(id) {
+			missing.IDs = append(missing.IDs, id)
+		}
+	}
+	if len(missing.IDs) == 0 {
+		return
+	}
+	q := n.peers.Get(addr)
+	if q == nil {
+		return // A read-only connection; the peer will ask again.
+	}
+	env, err := NewEnvelope(TypeWant, missing)
+	if err != nil {
+		return
+	}
+	select {
+	case q.ctl <- env:
+		n.logger().Debug("requesting missed messages", "dir", "in", "remote", c.RemoteAddr(), "count", len(missing.IDs))
+	default:
+	}
+}
+
+// resend queues the messages named in dg for the peer at addr.
+func (n *Node) resend(dg Digest, addr string) {
+	q := n.peers.Get(addr)
+	if q == nil {
+		return
+	}
+	timeout := n.blockTimeout()
+	for _, id := range dg.IDs {
+		if m, ok := n.recent.get(id); ok {
+			q.Put(m, n.Overflow, timeout)
+		}
+	}
+}
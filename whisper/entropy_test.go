@@ -0,0 +1,51 @@
+package whisper
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRecent(t *testing.T) {
+	var r recent
+	r.m = make(map[string]recentEntry)
+	start := time.Unix(0, 0)
+	for i := 0; i < recentMax+10; i++ {
+		r.add(Message{ID: fmt.Sprint(i)}, start)
+	}
+	if got := len(r.digest(start).IDs); got != recentMax {
+		t.Errorf("digest has %d IDs, want %d", got, recentMax)
+	}
+	if _, ok := r.get("0"); ok {
+		t.Error("oldest message kept beyond recentMax")
+	}
+	if got := len(r.digest(start.Add(recentWindow + time.Second)).IDs); got != 0 {
+		t.Errorf("digest has %d IDs after window, want 0", got)
+	}
+}
+
+func TestAntiEntropy(t *testing.T) {
+	a, b := newTestNode(t), newTestNode(t)
+	defer a.Close()
+	defer b.Close()
+	a.AntiEntropyInterval = 20 * time.Millisecond
+	chB, cancel := b.Subscribe()
+	defer cancel()
+	b.Start(context.Background())
+	a.Start(context.Background(), b.Addr())
+
+	// A message a sent but whose broadcast to b was lost.
+	m := a.newMessage("lost", 0)
+	a.Seen(m.ID)
+	a.recent.add(m, time.Now())
+
+	select {
+	case got := <-chB:
+		if got.ID != m.ID {
+			t.Errorf("got %+v, want %+v", got, m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lost message not recovered")
+	}
+}
@@ -0,0 +1,150 @@
+package whisper
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxHistoryReply caps the number of messages sent in answer to a history
+// request.
+const maxHistoryReply = 1000
+
+// History is an append-only log of messages, stored in a local file as one
+// JSON record per line.
+type History struct {
+	mu   sync.Mutex
+	f    *os.File
+	path string
+	now  func() time.Time
+}
+
+// HistoryRequest is the payload of a TypeHistoryRequest envelope.
+// It asks for the Last messages (all, if zero) logged after Since (ever,
+// if zero), up to a limit set by the answering node.
+type HistoryRequest struct {
+	Last  int
+	Since time.Time
+}
+
+// historyRecord is a line of the history file.
+type historyRecord struct {
+	Time    time.Time
+	Message Message
+}
+
+// OpenHistory opens the history file at path, creating it if necessary.
+func OpenHistory(path string) (*History, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &History{f: f, path: path, now: time.Now}, nil
+}
+
+// Append logs m as received now.
+func (h *History) Append(m Message) error {
+	b, err := json.Marshal(historyRecord{Time: h.now(), Message: m})
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err = h.f.Write(append(b, '\n'))
+	return err
+}
+
+// Query returns the messages matching req, oldest first.
+func (h *History) Query(req HistoryRequest) ([]Message, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, err := os.Open(h.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	last := req.Last
+	if last <= 0 || last > maxHistoryReply {
+		last = maxHistoryReply
+	}
+	var l []Message
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		var r historyRecord
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			continue // a partly written record
+		}
+		if !r.Time.After(req.Since) {
+			continue
+		}
+		l = append(l, r.Message)
+		if len(l) > last {
+			copy(l, l[1:])
+			l = l[:last]
+		}
+	}
+	return l, s.Err()
+}
+
+// Close closes the history file.
+func (h *History) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.f.Close()
+}
+
+// record appends m to the node's history, if it keeps one.
+func (n *Node) record(m Message) {
+	if n.History == nil {
+		return
+	}
+	if err := n.History.Append(m); err != nil {
+		n.logger().Error("history error", "err", err)
+	}
+}
+
+// requestHistory sends the node's SyncHistory request, if any.
+func (n *Node) requestHistory(e *json.Encoder) error {
+	if n.SyncHistory == nil {
+		return nil
+	}
+	env, err := NewEnvelope(TypeHistoryRequest, n.SyncHistory)
+	if err != nil {
+		return err
+	}
+	return e.Encode(env)
+}
+
+// answerHistory queues a reply to a history request from the peer at addr,
+// received on c. The request is ignored if the node keeps no history.
+func (n *Node) answerHistory(c net.Conn, req HistoryRequest, addr string) {
+	if n.History == nil {
+		return
+	}
+	q := n.peers.Get(addr)
+	if q == nil {
+		n.logger().Warn("history request from unknown peer", "dir", "in", "remote", c.RemoteAddr())
+		return
+	}
+	l, err := n.History.Query(req)
+	if err != nil {
+		n.logger().Error("history error", "err", err)
+		return
+	}
+	env, err := NewEnvelope(TypeHistory, l)
+	if err != nil {
+		n.logger().Error("history error", "err", err)
+		return
+	}
+	select {
+	case q.ctl <- env:
+		n.logger().Info("sending history", "dir", "out", "peer", addr, "count", len(l))
+	default:
+		n.logger().Warn("dropped history reply: queue full", "dir", "out", "peer", addr)
+	}
+}
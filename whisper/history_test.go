@@ -0,0 +1,102 @@
+package whisper
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func openTestHistory(t *testing.T) *History {
+	dir, err := ioutil.TempDir("", "whisper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	h, err := OpenHistory(filepath.Join(dir, "history"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func bodies(l []Message) []string {
+	var s []string
+	for _, m := range l {
+		s = append(s, m.Body)
+	}
+	return s
+}
+
+func TestHistory(t *testing.T) {
+	h := openTestHistory(t)
+	start := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	h.now = func() time.Time { return now }
+	for i := 0; i < 5; i++ {
+		now = start.Add(time.Duration(i) * time.Minute)
+		if err := h.Append(Message{ID: fmt.Sprint(i), Body: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		req  HistoryRequest
+		want []string
+	}{
+		{HistoryRequest{}, []string{"0", "1", "2", "3", "4"}},
+		{HistoryRequest{Last: 2}, []string{"3", "4"}},
+		{HistoryRequest{Since: start.Add(90 * time.Second)}, []string{"2", "3", "4"}},
+		{HistoryRequest{Last: 1, Since: start}, []string{"4"}},
+		{HistoryRequest{Since: now}, nil},
+	} {
+		l, err := h.Query(tt.req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := bodies(l); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Query(%+v) = %q, want %q", tt.req, got, tt.want)
+		}
+	}
+}
+
+func TestHistorySync(t *testing.T) {
+	a, b := newTestNode(t), newTestNode(t)
+	defer a.Close()
+	defer b.Close()
+	a.History = openTestHistory(t)
+	b.History = openTestHistory(t)
+	b.SyncHistory = &HistoryRequest{Last: 2}
+	for _, s := range []string{"one", "two", "three"} {
+		a.Send(s)
+	}
+	chB, cancel := b.Subscribe()
+	defer cancel()
+	a.Start(context.Background())
+	b.Start(context.Background(), a.Addr())
+
+	var got []string
+	for len(got) < 2 {
+		select {
+		case m := <-chB:
+			got = append(got, m.Body)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %q, want 2 messages of history", got)
+		}
+	}
+	if want := []string{"two", "three"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %q, want %q", got, want)
+	}
+	l, err := b.History.Query(HistoryRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bodies(l); !reflect.DeepEqual(got, []string{"two", "three"}) {
+		t.Errorf("b history = %q, want replayed messages", got)
+	}
+}
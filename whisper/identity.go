@@ -0,0 +1,187 @@
+package whisper
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Identity is a node's ed25519 key pair, used to sign the messages it
+// originates.
+type Identity struct {
+	Public  ed25519.PublicKey
+	private ed25519.PrivateKey
+}
+
+// NewIdentity generates a new random identity.
+func NewIdentity() (*Identity, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{Public: pub, private: priv}, nil
+}
+
+// LoadIdentity reads the identity stored in the PEM file at path.
+// If the file does not exist, it generates a new identity and saves it
+// there, so that the node keeps its identity across restarts.
+func LoadIdentity(path string) (*Identity, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		id, err := NewIdentity()
+		if err != nil {
+			return nil, err
+		}
+		return id, id.save(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%v: no private key found", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%v: not an ed25519 key", path)
+	}
+	return &Identity{Public: priv.Public().(ed25519.PublicKey), private: priv}, nil
+}
+
+func (id *Identity) save(path string) error {
+	der, err := x509.MarshalPKCS8PrivateKey(id.private)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	b := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+// String returns the identity's public key in the form used in messages.
+func (id *Identity) String() string {
+	return KeyString(id.Public)
+}
+
+// Sign sets the Key and Sig fields of m.
+func (id *Identity) Sign(m *Message) {
+	m.Key = KeyString(id.Public)
+	m.Sig = base64.StdEncoding.EncodeToString(ed25519.Sign(id.private, m.signedBytes()))
+}
+
+// signHello sets the Key and Sig fields of h.
+func (id *Identity) signHello(h *Hello) {
+	h.Key = KeyString(id.Public)
+	h.Sig = base64.StdEncoding.EncodeToString(ed25519.Sign(id.private, []byte(h.Addr)))
+}
+
+// verifyHello reports whether h carries a valid signature of its address.
+func verifyHello(h Hello) bool {
+	pub, err := ParseKey(h.Key)
+	if err != nil {
+		return false
+	}
+	sig, err := base64.StdEncoding.DecodeString(h.Sig)
+	return err == nil && ed25519.Verify(pub, []byte(h.Addr), sig)
+}
+
+// KeyString encodes a public key in the form used in messages.
+func KeyString(pub ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(pub)
+}
+
+// ParseKey decodes a public key in the form used in messages.
+func ParseKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("bad public key length %d", len(b))
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// LoadKeys reads a file of public keys, one per line in the form used in
+// messages. Blank lines and lines starting with # are ignored.
+func LoadKeys(path string) ([]ed25519.PublicKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []ed25519.PublicKey
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, err := ParseKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("%v:%d: %v", path, i+1, err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// Errors returned by Verify.
+var (
+	ErrUnsigned  = errors.New("message is not signed")
+	ErrBadSig    = errors.New("bad message signature")
+	ErrUntrusted = errors.New("message signed by untrusted key")
+)
+
+// Verify checks the signature of m. If trusted is non-empty, it also
+// requires m to be signed by one of the keys in it.
+func Verify(m Message, trusted []ed25519.PublicKey) error {
+	if m.Sig == "" {
+		return ErrUnsigned
+	}
+	pub, err := ParseKey(m.Key)
+	if err != nil {
+		return ErrBadSig
+	}
+	sig, err := base64.StdEncoding.DecodeString(m.Sig)
+	if err != nil || !ed25519.Verify(pub, m.signedBytes(), sig) {
+		return ErrBadSig
+	}
+	if len(trusted) == 0 {
+		return nil
+	}
+	for _, k := range trusted {
+		if bytes.Equal(k, pub) {
+			return nil
+		}
+	}
+	return ErrUntrusted
+}
+
+// signedBytes returns the parts of m covered by its signature.
+// The hop count changes in transit and is not signed. Fields added later
+// are omitted when empty, so that older signatures stay valid.
+func (m Message) signedBytes() []byte {
+	b, _ := json.Marshal(struct {
+		ID, Addr, Body, Key string
+		To                  string `json:",omitempty"`
+		Channel             string `json:",omitempty"`
+		Clock               uint64 `json:",omitempty"`
+		ReplyTo             string `json:",omitempty"`
+	}{m.ID, m.Addr, m.Body, m.Key, m.To, m.Channel, m.Clock, m.ReplyTo})
+	return b
+}
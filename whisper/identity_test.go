@@ -0,0 +1,94 @@
+package whisper
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "whisper-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "key")
+
+	id1, err := LoadIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := LoadIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !id1.Public.Equal(id2.Public) {
+		t.Error("identity not persisted")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	id, _ := NewIdentity()
+	other, _ := NewIdentity()
+	m := Message{ID: "1", Addr: "a", Body: "hello"}
+	if err := Verify(m, nil); err != ErrUnsigned {
+		t.Errorf("unsigned: Verify = %v, want %v", err, ErrUnsigned)
+	}
+	id.Sign(&m)
+	if err := Verify(m, nil); err != nil {
+		t.Errorf("signed: Verify = %v, want nil", err)
+	}
+	m.TTL = 3 // not covered by the signature
+	if err := Verify(m, []ed25519.PublicKey{id.Public}); err != nil {
+		t.Errorf("trusted: Verify = %v, want nil", err)
+	}
+	if err := Verify(m, []ed25519.PublicKey{other.Public}); err != ErrUntrusted {
+		t.Errorf("untrusted: Verify = %v, want %v", err, ErrUntrusted)
+	}
+	forged := m
+	forged.Body = "goodbye"
+	if err := Verify(forged, nil); err != ErrBadSig {
+		t.Errorf("forged: Verify = %v, want %v", err, ErrBadSig)
+	}
+}
+
+func TestVerifyOldSignature(t *testing.T) {
+	// Signed as by a node that predates direct messages and channels.
+	id, _ := NewIdentity()
+	m := Message{ID: "1", Addr: "a", Body: "hello", Key: KeyString(id.Public)}
+	b, _ := json.Marshal(struct {
+		ID, Addr, Body, Key string
+	}{m.ID, m.Addr, m.Body, m.Key})
+	m.Sig = base64.StdEncoding.EncodeToString(ed25519.Sign(id.private, b))
+	if err := Verify(m, nil); err != nil {
+		t.Errorf("old signature: Verify = %v, want nil", err)
+	}
+}
+
+func TestNodeVerify(t *testing.T) {
+	n := newTestNode(t)
+	defer n.Close()
+	id, _ := NewIdentity()
+	signed := Message{ID: "1"}
+	id.Sign(&signed)
+
+	if err := n.verify(Message{ID: "2"}); err != nil {
+		t.Errorf("unsigned accepted by default: got %v", err)
+	}
+	n.RequireSignatures = true
+	if err := n.verify(Message{ID: "2"}); err == nil {
+		t.Error("unsigned accepted with RequireSignatures")
+	}
+	n.RequireSignatures = false
+	n.TrustedKeys = []ed25519.PublicKey{id.Public}
+	if err := n.verify(signed); err != nil {
+		t.Errorf("trusted signature rejected: %v", err)
+	}
+	if err := n.verify(Message{ID: "2"}); err == nil {
+		t.Error("unsigned accepted with TrustedKeys")
+	}
+}
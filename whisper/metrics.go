@@ -0,0 +1,134 @@
+package whisper
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// stats holds the counters reported by the node's metrics.
+type stats struct {
+	mu           sync.Mutex
+	peers        map[string]*peerStats
+	dialFailures uint64 // accessed atomically
+}
+
+// peerStats counts the messages exchanged with a peer, over all
+// connections to it. Its fields are accessed atomically.
+type peerStats struct {
+	received  uint64 // messages received, including duplicates
+	sent      uint64
+	dropped   uint64 // by connections that have closed; see Peer.Dropped
+	duplicate uint64 // messages received that had already been seen
+}
+
+// peer returns the counters for the peer at addr, or for peers of unknown
+// address if addr is empty.
+func (s *stats) peer(addr string) *peerStats {
+	if addr == "" {
+		addr = "unknown"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ps, ok := s.peers[addr]
+	if !ok {
+		ps = new(peerStats)
+		s.peers[addr] = ps
+	}
+	return ps
+}
+
+// remove unregisters q, keeping count of the messages it dropped.
+func (n *Node) remove(q *Peer) {
+	n.peers.Remove(q.Addr)
+	atomic.AddUint64(&n.stats.peer(q.Addr).dropped, q.Dropped())
+}
+
+// MetricsHandler returns a handler that serves the node's metrics in the
+// Prometheus text exposition format.
+func (n *Node) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		n.WriteMetrics(w)
+	})
+}
+
+// WriteMetrics writes the node's metrics to w in the Prometheus text
+// exposition format.
+func (n *Node) WriteMetrics(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(b, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, typ)
+	}
+
+	live := make(map[string]*Peer)
+	for _, q := range n.peers.List() {
+		live[q.Addr] = q
+	}
+	n.stats.mu.Lock()
+	addrs := make([]string, 0, len(n.stats.peers))
+	for addr := range n.stats.peers {
+		addrs = append(addrs, addr)
+	}
+	n.stats.mu.Unlock()
+	sort.Strings(addrs)
+	perPeer := func(name, help string, v func(addr string, ps *peerStats) uint64) {
+		metric(name, "counter", help)
+		for _, addr := range addrs {
+			fmt.Fprintf(b, "%v{peer=%v} %v\n", name, quote(addr), v(addr, n.stats.peer(addr)))
+		}
+	}
+
+	metric("whisper_peers", "gauge", "Number of connected peers.")
+	fmt.Fprintf(b, "whisper_peers %v\n", len(live))
+	perPeer("whisper_messages_received_total", "Messages received from each peer, including duplicates.",
+		func(_ string, ps *peerStats) uint64 { return atomic.LoadUint64(&ps.received) })
+	perPeer("whisper_messages_sent_total", "Messages sent to each peer.",
+		func(_ string, ps *peerStats) uint64 { return atomic.LoadUint64(&ps.sent) })
+	perPeer("whisper_messages_dropped_total", "Messages dropped because a peer's queue was full.",
+		func(addr string, ps *peerStats) uint64 {
+			d := atomic.LoadUint64(&ps.dropped)
+			if q := live[addr]; q != nil {
+				d += q.Dropped()
+			}
+			return d
+		})
+	perPeer("whisper_messages_duplicate_total", "Messages received from each peer that had already been seen.",
+		func(_ string, ps *peerStats) uint64 { return atomic.LoadUint64(&ps.duplicate) })
+
+	metric("whisper_queue_length", "gauge", "Messages waiting to be sent to each connected peer.")
+	for _, addr := range addrs {
+		if q := live[addr]; q != nil {
+			fmt.Fprintf(b, "whisper_queue_length{peer=%v} %v\n", quote(addr), q.Len())
+		}
+	}
+
+	metric("whisper_dial_failures_total", "counter", "Failed attempts to connect to a peer.")
+	fmt.Fprintf(b, "whisper_dial_failures_total %v\n", atomic.LoadUint64(&n.stats.dialFailures))
+
+	st := n.SeenIDs.Stats()
+	metric("whisper_seen_hits_total", "counter", "Lookups of message IDs already seen.")
+	fmt.Fprintf(b, "whisper_seen_hits_total %v\n", st.Hits)
+	metric("whisper_seen_misses_total", "counter", "Lookups of new message IDs.")
+	fmt.Fprintf(b, "whisper_seen_misses_total %v\n", st.Misses)
+	metric("whisper_seen_evictions_total", "counter", "Message IDs forgotten to make room for new ones.")
+	fmt.Fprintf(b, "whisper_seen_evictions_total %v\n", st.Evictions)
+	metric("whisper_seen_ids", "gauge", "Message IDs remembered for de-duplication.")
+	fmt.Fprintf(b, "whisper_seen_ids %v\n", st.Len)
+
+	metric("go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	fmt.Fprintf(b, "go_goroutines %v\n", runtime.NumGoroutine())
+	return b.Flush()
+}
+
+// quote returns s as a label value.
+func quote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
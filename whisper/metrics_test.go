@@ -0,0 +1,75 @@
+package whisper
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	a, b := newTestNode(t), newTestNode(t)
+	defer a.Close()
+	defer b.Close()
+	chB, cancel := b.Subscribe()
+	defer cancel()
+	b.Start(context.Background())
+	a.Start(context.Background(), b.Addr())
+	m := sendUntil(t, a, chB, "counted")
+	// Deliver it again, as a second route through the mesh would.
+	b.take(nil, m, a.Addr())
+
+	var buf bytes.Buffer
+	if err := b.WriteMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	s := buf.String()
+	for _, want := range []string{
+		"# TYPE whisper_peers gauge\nwhisper_peers 1\n",
+		fmt.Sprintf("whisper_messages_duplicate_total{peer=%q} 1\n", a.Addr()),
+		"# TYPE go_goroutines gauge\n",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("metrics lack %q:\n%s", want, s)
+		}
+	}
+	if strings.Contains(s, fmt.Sprintf("whisper_messages_received_total{peer=%q} 0\n", a.Addr())) {
+		t.Errorf("no messages counted as received:\n%s", s)
+	}
+}
+
+func TestDialFailures(t *testing.T) {
+	a, b := newTestNode(t), newTestNode(t)
+	defer a.Close()
+	defer b.Close()
+	conns := make(chan net.Conn, 2)
+	a.Dial = func(_ context.Context, addr string) (net.Conn, error) {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			conns <- c
+		}
+		return c, err
+	}
+	chB, cancel := b.Subscribe()
+	defer cancel()
+	b.Start(context.Background())
+	a.Start(context.Background(), b.Addr())
+	sendUntil(t, a, chB, "before")
+
+	// Drop the session; a should redial without counting a failure.
+	(<-conns).Close()
+	sendUntil(t, a, chB, "after")
+	<-conns
+	if n := atomic.LoadUint64(&a.stats.dialFailures); n != 0 {
+		t.Errorf("dial failures = %d after a dropped session, want 0", n)
+	}
+}
+
+func TestQuote(t *testing.T) {
+	if got, want := quote("a\"b\\c\n"), `"a\"b\\c\n"`; got != want {
+		t.Errorf("quote = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,155 @@
+package whisper
+
+import (
+	"sort"
+	"time"
+)
+
+// DefaultOrderWindow is a suitable window for Ordered.
+const DefaultOrderWindow = 500 * time.Millisecond
+
+// releasedMax is the number of released message IDs an ordering buffer
+// remembers, to tell whether a reply's parent has already been shown.
+const releasedMax = 1024
+
+// Ordered reads messages from in, such as a channel returned by Subscribe,
+// and returns a channel on which they are delivered in causal order.
+//
+// Each message is held for up to window after it arrives, and messages are
+// released in order of their Clock, so that a message is shown after those
+// its sender had seen when sending it, provided they arrive within the
+// window. A reply whose parent has not arrived is held for up to another
+// window in case it does.
+// The returned channel is closed after in is closed and the buffered
+// messages are delivered.
+func Ordered(in <-chan Message, window time.Duration) <-chan Message {
+	out := make(chan Message, 16)
+	go func() {
+		defer close(out)
+		r := newReorder(window)
+		t := time.NewTimer(time.Hour)
+		defer t.Stop()
+		for {
+			var wake <-chan time.Time
+			if d, ok := r.next(); ok {
+				t.Reset(time.Until(d))
+				wake = t.C
+			}
+			select {
+			case m, ok := <-in:
+				if !ok {
+					for _, m := range r.flush() {
+						out <- m
+					}
+					return
+				}
+				r.add(m, time.Now())
+			case <-wake:
+			}
+			if !t.Stop() {
+				select {
+				case <-t.C:
+				default:
+				}
+			}
+			for _, m := range r.pop(time.Now()) {
+				out <- m
+			}
+		}
+	}()
+	return out
+}
+
+// reorder is the buffer behind Ordered.
+type reorder struct {
+	window   time.Duration
+	buf      []pending // sorted by before
+	released map[string]bool
+	order    []string // released IDs, oldest first
+}
+
+type pending struct {
+	m        Message
+	deadline time.Time
+}
+
+func newReorder(window time.Duration) *reorder {
+	return &reorder{window: window, released: make(map[string]bool)}
+}
+
+// before reports whether a should be shown before b.
+func before(a, b Message) bool {
+	if a.Clock != b.Clock {
+		return a.Clock < b.Clock
+	}
+	if a.Addr != b.Addr {
+		return a.Addr < b.Addr
+	}
+	return a.ID < b.ID
+}
+
+func (r *reorder) add(m Message, now time.Time) {
+	p := pending{m, now.Add(r.window)}
+	if m.ReplyTo != "" && !r.released[m.ReplyTo] && !r.holds(m.ReplyTo) {
+		p.deadline = p.deadline.Add(r.window)
+	}
+	i := sort.Search(len(r.buf), func(i int) bool { return before(m, r.buf[i].m) })
+	r.buf = append(r.buf, pending{})
+	copy(r.buf[i+1:], r.buf[i:])
+	r.buf[i] = p
+}
+
+func (r *reorder) holds(id string) bool {
+	for _, p := range r.buf {
+		if p.m.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// next returns the earliest deadline of a buffered message.
+func (r *reorder) next() (time.Time, bool) {
+	var t time.Time
+	for _, p := range r.buf {
+		if t.IsZero() || p.deadline.Before(t) {
+			t = p.deadline
+		}
+	}
+	return t, !t.IsZero()
+}
+
+// pop removes and returns, in order, the messages due at now and any
+// that should be shown before them.
+func (r *reorder) pop(now time.Time) []Message {
+	n := 0
+	for i, p := range r.buf {
+		if !p.deadline.After(now) {
+			n = i + 1
+		}
+	}
+	return r.release(n)
+}
+
+// flush removes and returns all buffered messages in order.
+func (r *reorder) flush() []Message {
+	return r.release(len(r.buf))
+}
+
+func (r *reorder) release(n int) []Message {
+	if n == 0 {
+		return nil
+	}
+	l := make([]Message, n)
+	for i, p := range r.buf[:n] {
+		l[i] = p.m
+		r.released[p.m.ID] = true
+		r.order = append(r.order, p.m.ID)
+	}
+	r.buf = append(r.buf[:0], r.buf[n:]...)
+	for len(r.order) > releasedMax {
+		delete(r.released, r.order[0])
+		r.order = r.order[1:]
+	}
+	return l
+}
@@ -0,0 +1,92 @@
+package whisper
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func ids(l []Message) []string {
+	var s []string
+	for _, m := range l {
+		s = append(s, m.ID)
+	}
+	return s
+}
+
+func TestReorder(t *testing.T) {
+	now := time.Unix(0, 0)
+	w := time.Second
+	r := newReorder(w)
+	r.add(Message{ID: "reply", Clock: 5, ReplyTo: "parent"}, now)
+	r.add(Message{ID: "late", Clock: 9}, now)
+	now = now.Add(w / 2)
+	r.add(Message{ID: "parent", Clock: 4}, now)
+	r.add(Message{ID: "orphan", Clock: 7, ReplyTo: "lost"}, now)
+	r.add(Message{ID: "x", Clock: 8}, now)
+
+	if got := r.pop(now); got != nil {
+		t.Errorf("pop before deadline = %q, want none", ids(got))
+	}
+	// "late" is due; "parent" and "reply" sort before it but "orphan",
+	// waiting for its parent, sorts between them.
+	if got, want := ids(r.pop(now.Add(w/2))), []string{"parent", "reply", "orphan", "x", "late"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("pop = %q, want %q", got, want)
+	}
+
+	r.add(Message{ID: "answer", Clock: 10, ReplyTo: "parent"}, now)
+	r.add(Message{ID: "orphan2", Clock: 11, ReplyTo: "lost"}, now)
+	if got, want := ids(r.pop(now.Add(w))), []string{"answer"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("pop = %q, want %q", got, want)
+	}
+	if got, want := ids(r.pop(now.Add(2*w))), []string{"orphan2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("pop = %q, want %q", got, want)
+	}
+}
+
+func TestOrdered(t *testing.T) {
+	in := make(chan Message, 3)
+	in <- Message{ID: "b", Clock: 2}
+	in <- Message{ID: "a", Clock: 1}
+	in <- Message{ID: "c", Clock: 3}
+	out := Ordered(in, 10*time.Millisecond)
+	var got []Message
+	for len(got) < 3 {
+		select {
+		case m := <-out:
+			got = append(got, m)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %q, want 3 messages", ids(got))
+		}
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(ids(got), want) {
+		t.Errorf("got %q, want %q", ids(got), want)
+	}
+	close(in)
+	if _, ok := <-out; ok {
+		t.Error("output not closed after input")
+	}
+}
+
+func TestClock(t *testing.T) {
+	a, b := newTestNode(t), newTestNode(t)
+	defer a.Close()
+	defer b.Close()
+	chB, cancel := b.Subscribe()
+	defer cancel()
+	b.Start(context.Background())
+	a.Start(context.Background(), b.Addr())
+
+	for i := 0; i < 5; i++ {
+		a.Send("tick")
+	}
+	m := sendUntil(t, a, chB, "question")
+	r, err := b.Reply(m, "answer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Clock <= m.Clock || r.ReplyTo != m.ID {
+		t.Errorf("reply %+v to %+v: want a later clock and ReplyTo", r, m)
+	}
+}
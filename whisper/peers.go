@@ -0,0 +1,172 @@
+package whisper
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Peers is a registry of the peers a Node is connected to.
+// Each peer is represented by a queue of outgoing messages.
+type Peers struct {
+	m  map[string]*Peer
+	mu sync.RWMutex
+}
+
+// NewPeers returns an empty peer registry.
+func NewPeers() *Peers {
+	return &Peers{m: make(map[string]*Peer)}
+}
+
+// Add creates and returns a new queue holding up to size messages for the
+// given peer address.
+// If an address already exists in the registry, or max is positive and the
+// registry already holds max peers, it returns nil.
+func (p *Peers) Add(addr string, size, max int) *Peer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.m[addr]; ok {
+		return nil
+	}
+	if max > 0 && len(p.m) >= max {
+		return nil
+	}
+	q := &Peer{
+		Addr: addr,
+		ch:   make(chan Message, size),
+		ctl:  make(chan Envelope, 16),
+		slow: make(chan struct{}, 1),
+	}
+	p.m[addr] = q
+	return q
+}
+
+// Remove deletes the specified peer from the registry.
+func (p *Peers) Remove(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.m, addr)
+}
+
+// List returns a slice of all active peer queues.
+func (p *Peers) List() []*Peer {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	l := make([]*Peer, 0, len(p.m))
+	for _, q := range p.m {
+		l = append(l, q)
+	}
+	return l
+}
+
+// Get returns the queue for the given address, or nil if there is none.
+func (p *Peers) Get(addr string) *Peer {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.m[addr]
+}
+
+// Defaults for the outgoing message queue of each peer.
+const (
+	DefaultQueueSize    = 64
+	DefaultBlockTimeout = 100 * time.Millisecond
+)
+
+// Peer is the bounded queue of messages waiting to be sent to a peer.
+type Peer struct {
+	Addr string
+
+	ch      chan Message
+	ctl     chan Envelope // envelopes for this peer alone, such as replies
+	slow    chan struct{} // signalled when the peer should be disconnected
+	dropped uint64
+}
+
+// Len returns the number of messages waiting to be sent.
+func (q *Peer) Len() int {
+	return len(q.ch)
+}
+
+// Dropped returns the number of messages dropped because the queue was full.
+func (q *Peer) Dropped() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
+
+// Put adds m to the queue, applying policy if the queue is full.
+// Under the Block policy it waits at most timeout for room in the queue.
+func (q *Peer) Put(m Message, policy Overflow, timeout time.Duration) {
+	select {
+	case q.ch <- m:
+		return
+	default:
+	}
+	switch policy {
+	case DropOldest:
+		for {
+			select {
+			case <-q.ch:
+				atomic.AddUint64(&q.dropped, 1)
+			default:
+			}
+			select {
+			case q.ch <- m:
+				return
+			default:
+			}
+		}
+	case Block:
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		select {
+		case q.ch <- m:
+		case <-t.C:
+			atomic.AddUint64(&q.dropped, 1)
+		}
+	case Disconnect:
+		atomic.AddUint64(&q.dropped, 1)
+		select {
+		case q.slow <- struct{}{}:
+		default:
+		}
+	default: // DropNewest
+		atomic.AddUint64(&q.dropped, 1)
+	}
+}
+
+// Overflow is the policy applied when a message is sent to a peer whose
+// queue is full.
+type Overflow int
+
+const (
+	DropOldest Overflow = iota // discard the oldest queued message
+	DropNewest                 // discard the message being sent
+	Block                      // wait for room, up to a timeout
+	Disconnect                 // discard the message and drop the connection
+)
+
+var overflowNames = []string{
+	DropOldest: "drop-oldest",
+	DropNewest: "drop-newest",
+	Block:      "block",
+	Disconnect: "disconnect",
+}
+
+func (o Overflow) String() string {
+	if o < 0 || int(o) >= len(overflowNames) {
+		return fmt.Sprintf("Overflow(%d)", int(o))
+	}
+	return overflowNames[o]
+}
+
+// Set parses an overflow policy name, so that an Overflow may be used as a
+// flag.Value.
+func (o *Overflow) Set(s string) error {
+	for i, name := range overflowNames {
+		if s == name {
+			*o = Overflow(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown overflow policy %q", s)
+}
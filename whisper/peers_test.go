@@ -0,0 +1,74 @@
+package whisper
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeers(t *testing.T) {
+	peers := NewPeers()
+	a := peers.Add("a", 1, 0)
+	if a == nil {
+		t.Fatal(`peers.Add("a") returned nil, want queue`)
+	}
+	if peers.Add("a", 1, 0) != nil {
+		t.Fatal(`second peers.Add("a") returned non-nil queue, want nil`)
+	}
+	peers.Add("b", 1, 0)
+	if l := peers.List(); len(l) != 2 {
+		t.Fatalf("peers.List() returned a list of length %d, want 2", len(l))
+	}
+	if peers.Add("c", 1, 2) != nil {
+		t.Fatal(`peers.Add("c") beyond max returned non-nil queue, want nil`)
+	}
+	peers.Remove("a")
+	if peers.Get("a") != nil {
+		t.Fatal(`peers.Get("a") returned queue after Remove`)
+	}
+}
+
+func TestPeerOverflow(t *testing.T) {
+	for _, tt := range []struct {
+		policy Overflow
+		want   []string // bodies left in the queue
+		slow   bool
+	}{
+		{DropOldest, []string{"2", "3"}, false},
+		{DropNewest, []string{"1", "2"}, false},
+		{Block, []string{"1", "2"}, false},
+		{Disconnect, []string{"1", "2"}, true},
+	} {
+		q := NewPeers().Add("a", 2, 0)
+		for _, body := range []string{"1", "2", "3"} {
+			q.Put(Message{Body: body}, tt.policy, time.Millisecond)
+		}
+		if q.Dropped() != 1 {
+			t.Errorf("%v: Dropped() = %d, want 1", tt.policy, q.Dropped())
+		}
+		for _, want := range tt.want {
+			if m := <-q.ch; m.Body != want {
+				t.Errorf("%v: dequeued %q, want %q", tt.policy, m.Body, want)
+			}
+		}
+		select {
+		case <-q.slow:
+			if !tt.slow {
+				t.Errorf("%v: peer marked slow", tt.policy)
+			}
+		default:
+			if tt.slow {
+				t.Errorf("%v: peer not marked slow", tt.policy)
+			}
+		}
+	}
+}
+
+func TestOverflowFlag(t *testing.T) {
+	var o Overflow
+	if err := o.Set("disconnect"); err != nil || o != Disconnect {
+		t.Errorf(`Set("disconnect") = %v, %v; want %v, nil`, o, err, Disconnect)
+	}
+	if err := o.Set("bogus"); err == nil {
+		t.Error(`Set("bogus") succeeded, want error`)
+	}
+}
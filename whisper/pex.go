@@ -0,0 +1,117 @@
+package whisper
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Defaults for peer exchange.
+const (
+	DefaultMinPeers    = 3
+	DefaultPEXInterval = 30 * time.Second
+	pexSampleSize      = 8
+)
+
+// PeerList is the payload of a TypePeers envelope: a sample of the
+// addresses the sender knows about.
+// Peer lists are exchanged between neighbours and never relayed.
+type PeerList struct {
+	Addrs []string
+}
+
+// known is the set of peer addresses a node has heard of.
+type known struct {
+	mu sync.Mutex
+	m  map[string]bool
+}
+
+func (k *known) add(addr string) {
+	k.mu.Lock()
+	k.m[addr] = true
+	k.mu.Unlock()
+}
+
+func (k *known) list() []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	l := make([]string, 0, len(k.m))
+	for addr := range k.m {
+		l = append(l, addr)
+	}
+	return l
+}
+
+// sample returns up to n randomly chosen elements of l, reordering l.
+func sample(l []string, n int) []string {
+	rand.Shuffle(len(l), func(i, j int) { l[i], l[j] = l[j], l[i] })
+	if len(l) > n {
+		l = l[:n]
+	}
+	return l
+}
+
+// peerSample returns a sample of the addresses of connected peers,
+// including the node itself, to send to a neighbour.
+func (n *Node) peerSample() PeerList {
+	var addrs []string
+	for _, q := range n.peers.List() {
+		addrs = append(addrs, q.Addr)
+	}
+	return PeerList{Addrs: append(sample(addrs, pexSampleSize-1), n.self)}
+}
+
+// learn records addresses heard from peers and dials them unless the node
+// already has MaxPeers connections.
+func (n *Node) learn(addrs ...string) {
+	for _, addr := range addrs {
+		if addr == "" || addr == n.self {
+			continue
+		}
+		n.known.add(addr)
+		addr := addr
+		n.goFunc(func() { n.dial(addr, n.MaxPeers) })
+	}
+}
+
+// maintain periodically dials known peers while the node has fewer than
+// MinPeers connections.
+func (n *Node) maintain() {
+	t := time.NewTicker(n.pexInterval())
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-n.ctx.Done():
+			return
+		}
+		min := n.MinPeers
+		if min == 0 {
+			min = DefaultMinPeers
+		}
+		want := min - len(n.peers.List())
+		// A negative MinPeers makes want negative, disabling this loop.
+		if want <= 0 {
+			continue
+		}
+		addrs := n.known.list()
+		for _, addr := range sample(addrs, len(addrs)) {
+			if want == 0 {
+				break
+			}
+			if addr == n.self || n.peers.Get(addr) != nil || !n.redial.alive(addr, time.Now()) {
+				continue
+			}
+			want--
+			addr := addr
+			n.goFunc(func() { n.dial(addr, n.MaxPeers) })
+		}
+	}
+}
+
+func (n *Node) pexInterval() time.Duration {
+	if n.PEXInterval > 0 {
+		return n.PEXInterval
+	}
+	return DefaultPEXInterval
+}
@@ -0,0 +1,50 @@
+package whisper
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeerExchange(t *testing.T) {
+	// a and c both know only b, and send no messages.
+	a, b, c := newTestNode(t), newTestNode(t), newTestNode(t)
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+	for _, n := range []*Node{a, b, c} {
+		n.PEXInterval = 20 * time.Millisecond
+	}
+	b.Start(context.Background())
+	a.Start(context.Background(), b.Addr())
+	c.Start(context.Background(), b.Addr())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for a.peers.Get(c.Addr()) == nil || c.peers.Get(a.Addr()) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("a and c did not discover each other")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMaxPeers(t *testing.T) {
+	n := newTestNode(t)
+	defer n.Close()
+	n.MaxPeers = 1
+	n.MinPeers = -1
+	n.Dial = func(context.Context, string) (net.Conn, error) {
+		return nil, errors.New("unreachable")
+	}
+	n.Backoff = Backoff{Initial: time.Hour}
+	n.learn("a", "b", "c")
+	time.Sleep(10 * time.Millisecond)
+	if got := len(n.peers.List()); got != 1 {
+		t.Errorf("dialling %d peers, want 1", got)
+	}
+	if got := len(n.known.list()); got != 3 {
+		t.Errorf("knows %d peers, want 3", got)
+	}
+}
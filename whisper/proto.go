@@ -0,0 +1,135 @@
+package whisper
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The version of the wire protocol spoken by this package.
+// Peers with a different major version are rejected; peers with a different
+// minor version are expected to ignore message types they don't know.
+const (
+	ProtocolMajor = 1
+	ProtocolMinor = 0
+)
+
+// ProtocolVersion is the version string sent in every Envelope.
+var ProtocolVersion = fmt.Sprintf("%d.%d", ProtocolMajor, ProtocolMinor)
+
+// Envelope types.
+const (
+	TypeHello   = "hello" // first envelope on a connection; payload is a Hello
+	TypeMessage = "msg"   // payload is a Message
+	TypeError   = "error" // payload is a string; the sender closes the connection
+	TypePeers   = "peers" // payload is a PeerList
+
+	TypeHistoryRequest = "history-request" // payload is a HistoryRequest
+	TypeHistory        = "history"         // payload is a []Message, oldest first
+
+	TypeDigest = "digest" // payload is a Digest of the sender's recent messages
+	TypeWant   = "want"   // payload is a Digest of the messages the sender lacks
+
+	TypeReport = "report" // payload is a Report, flooded like a message
+)
+
+// Envelope is the unit of transmission between nodes.
+//
+// Nodes that predate envelopes send bare Message objects instead.
+// These are recognized by their empty Version and still accepted.
+type Envelope struct {
+	Version string
+	Type    string
+	Time    time.Time
+	TTL     int             `json:",omitempty"` // remaining hops, if limited
+	Payload json.RawMessage `json:",omitempty"`
+}
+
+// Hello is the payload of the handshake envelope sent when a node connects
+// to a peer, and of the peer's reply.
+type Hello struct {
+	Addr string // the sender's listen address
+
+	// Key and Sig are the public key of the sender's Identity and its
+	// signature of Addr, if the sender has an identity.
+	Key string `json:",omitempty"`
+	Sig string `json:",omitempty"`
+}
+
+// helloEnvelope is the hello a dialling node sends. It also carries the ID
+// and Addr of a bare Message, so that a peer that predates envelopes, which
+// reads it as a message with no body, sees a new ID and relays it once
+// instead of rebroadcasting an ID-less message forever.
+type helloEnvelope struct {
+	Envelope
+	ID   string
+	Addr string
+}
+
+// NewEnvelope returns an envelope of the given type carrying payload,
+// stamped with the current protocol version and time.
+func NewEnvelope(typ string, payload interface{}) (Envelope, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return Envelope{}, err
+	}
+	return Envelope{
+		Version: ProtocolVersion,
+		Type:    typ,
+		Time:    time.Now(),
+		Payload: b,
+	}, nil
+}
+
+// Decode unmarshals the envelope's payload into v.
+func (e Envelope) Decode(v interface{}) error {
+	return json.Unmarshal(e.Payload, v)
+}
+
+// CheckVersion returns a *VersionError if e was sent by a node speaking an
+// incompatible protocol version.
+func (e Envelope) CheckVersion() error {
+	major, _, _ := strings.Cut(e.Version, ".")
+	if v, err := strconv.Atoi(major); err != nil || v != ProtocolMajor {
+		return &VersionError{e.Version}
+	}
+	return nil
+}
+
+// VersionError reports an envelope with an unsupported protocol version.
+type VersionError struct {
+	Version string
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("unsupported protocol version %q (want %d.x)", e.Version, ProtocolMajor)
+}
+
+// frame decodes either an Envelope or a bare Message from a pre-envelope peer.
+type frame struct {
+	Envelope
+	msg Message // the bare Message, if Version is empty
+}
+
+// UnmarshalJSON decodes b as an Envelope or, if it has no Version, as a
+// whole Message, so that a newer node's fields survive the trip through a
+// connection that carries bare messages.
+func (f *frame) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &f.Envelope); err != nil {
+		return err
+	}
+	if f.legacy() {
+		return json.Unmarshal(b, &f.msg)
+	}
+	return nil
+}
+
+func (f *frame) legacy() bool {
+	return f.Version == ""
+}
+
+func (f *frame) message() Message {
+	return f.msg
+}
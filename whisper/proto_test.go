@@ -0,0 +1,205 @@
+package whisper
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckVersion(t *testing.T) {
+	for _, tt := range []struct {
+		version string
+		ok      bool
+	}{
+		{ProtocolVersion, true},
+		{"1.7", true},
+		{"2.0", false},
+		{"0.9", false},
+		{"bogus", false},
+	} {
+		err := Envelope{Version: tt.version}.CheckVersion()
+		if (err == nil) != tt.ok {
+			t.Errorf("CheckVersion(%q) = %v, want ok=%v", tt.version, err, tt.ok)
+		}
+	}
+}
+
+func TestLegacyMessage(t *testing.T) {
+	n := newTestNode(t)
+	defer n.Close()
+	ch, cancel := n.Subscribe()
+	defer cancel()
+	n.Start(context.Background())
+
+	c, err := net.Dial("tcp", n.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// A newer node treating this one as old sends its fields too.
+	id, _ := NewIdentity()
+	want := Message{ID: "1", Addr: "a", Body: "old school", Clock: 7, ReplyTo: "0"}
+	id.Sign(&want)
+	if err := json.NewEncoder(c).Encode(want); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-ch:
+		if m != want {
+			t.Errorf("received %+v, want %+v", m, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("legacy message not delivered")
+	}
+}
+
+func TestRejectVersion(t *testing.T) {
+	n := newTestNode(t)
+	defer n.Close()
+	n.Start(context.Background())
+
+	c, err := net.Dial("tcp", n.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	hello := Envelope{Version: "2.0", Type: TypeHello}
+	if err := json.NewEncoder(c).Encode(hello); err != nil {
+		t.Fatal(err)
+	}
+	var reply Envelope
+	if err := json.NewDecoder(c).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	var msg string
+	reply.Decode(&msg)
+	if reply.Type != TypeError || !strings.Contains(msg, `"2.0"`) {
+		t.Errorf("reply = %v %q, want error naming version", reply.Type, msg)
+	}
+}
+
+func TestDialLegacyPeer(t *testing.T) {
+	defer func(d time.Duration) { handshakeTimeout = d }(handshakeTimeout)
+	handshakeTimeout = 50 * time.Millisecond
+
+	// A pre-envelope peer reads bare messages and never replies.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	msgs := make(chan Message, 100)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		d := json.NewDecoder(c)
+		for {
+			var m Message
+			if err := d.Decode(&m); err != nil {
+				return
+			}
+			msgs <- m
+		}
+	}()
+
+	n := newTestNode(t)
+	defer n.Close()
+	n.Start(context.Background(), l.Addr().String())
+
+	// The legacy peer sees the hello as a message with no body, but with
+	// an ID of its own so that it can be deduplicated.
+	select {
+	case m := <-msgs:
+		if m.ID == "" || m.Addr != n.Addr() || m.Body != "" {
+			t.Errorf("legacy peer read hello as %+v, want a new ID from %v", m, n.Addr())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("hello not sent")
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		sent := n.Send("hello")
+		select {
+		case m := <-msgs:
+			if m.Addr != sent.Addr || m.Body != sent.Body {
+				t.Errorf("legacy peer received %+v, want %+v", m, sent)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("message not delivered to legacy peer")
+		}
+	}
+}
+
+func TestSlowHello(t *testing.T) {
+	defer func(d time.Duration) { handshakeTimeout = d }(handshakeTimeout)
+	handshakeTimeout = 50 * time.Millisecond
+
+	// A current peer that answers the hello late.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	frames := make(chan frame, 100)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		d := json.NewDecoder(c)
+		var hello Envelope
+		if err := d.Decode(&hello); err != nil {
+			return
+		}
+		time.Sleep(4 * handshakeTimeout)
+		reply, _ := NewEnvelope(TypeHello, Hello{Addr: "10.0.0.1:1"})
+		if err := json.NewEncoder(c).Encode(reply); err != nil {
+			return
+		}
+		for {
+			var f frame
+			if err := d.Decode(&f); err != nil {
+				return
+			}
+			frames <- f
+		}
+	}()
+
+	n := newTestNode(t)
+	defer n.Close()
+	n.Identity, _ = NewIdentity()
+	n.Start(context.Background(), l.Addr().String())
+	timeout := time.After(5 * time.Second)
+	for {
+		n.Send("hello")
+		select {
+		case f := <-frames:
+			m := f.message()
+			if !f.legacy() {
+				if f.Type != TypeMessage {
+					continue
+				}
+				f.Decode(&m)
+			}
+			if m.Key == "" || m.Sig == "" || m.Clock == 0 {
+				t.Errorf("peer received %+v, want a signed message with a clock", m)
+			}
+			if !f.legacy() {
+				return
+			}
+		case <-time.After(50 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("no envelopes after late hello")
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package whisper
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Backoff controls how a Node reconnects to peers whose connection failed.
+// Zero fields take their values from DefaultBackoff.
+type Backoff struct {
+	Initial    time.Duration // delay before the first retry
+	Max        time.Duration // upper bound on the delay between retries
+	Multiplier float64       // factor by which the delay grows per failure
+	Jitter     float64       // randomize each delay by up to ±Jitter of itself
+
+	// MaxFailures is the number of consecutive failures after which a peer
+	// is considered dead. A dead peer is not dialled again, even if
+	// messages mention it, until Cooldown has passed.
+	MaxFailures int
+	Cooldown    time.Duration
+}
+
+// DefaultBackoff is the Backoff used for zero fields of Node.Backoff.
+var DefaultBackoff = Backoff{
+	Initial:     500 * time.Millisecond,
+	Max:         30 * time.Second,
+	Multiplier:  2,
+	Jitter:      0.2,
+	MaxFailures: 8,
+	Cooldown:    5 * time.Minute,
+}
+
+func (b Backoff) withDefaults() Backoff {
+	d := DefaultBackoff
+	if b.Initial > 0 {
+		d.Initial = b.Initial
+	}
+	if b.Max > 0 {
+		d.Max = b.Max
+	}
+	if b.Multiplier >= 1 {
+		d.Multiplier = b.Multiplier
+	}
+	if b.Jitter > 0 {
+		d.Jitter = b.Jitter
+	}
+	if b.MaxFailures > 0 {
+		d.MaxFailures = b.MaxFailures
+	}
+	if b.Cooldown > 0 {
+		d.Cooldown = b.Cooldown
+	}
+	return d
+}
+
+// delay returns the jittered delay before retrying after the given number
+// of consecutive failures.
+func (b Backoff) delay(failures int) time.Duration {
+	d := float64(b.Initial)
+	for i := 1; i < failures && d < float64(b.Max); i++ {
+		d *= b.Multiplier
+	}
+	if d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	d += d * b.Jitter * (2*rand.Float64() - 1)
+	return time.Duration(d)
+}
+
+// PeerState describes the connection to a peer the node knows about.
+type PeerState struct {
+	Addr        string
+	Connected   bool
+	Inbound     bool      // the peer dialled the node, rather than the reverse
+	Failures    int       // consecutive failed connection attempts
+	LastError   string    // most recent connection error, if any
+	NextAttempt time.Time // when the next reconnect is due, if not connected
+	DeadUntil   time.Time // if non-zero, the peer is not dialled until then
+	Queued      int       // messages waiting to be sent
+	Dropped     uint64    // messages dropped because the queue was full
+}
+
+// redialer tracks the reconnect state of known peers.
+type redialer struct {
+	mu sync.Mutex
+	m  map[string]*PeerState
+}
+
+// alive reports whether addr may be dialled, forgetting it if its cooldown
+// has passed.
+func (r *redialer) alive(addr string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.m[addr]
+	if !ok || s.DeadUntil.IsZero() {
+		return true
+	}
+	if now.Before(s.DeadUntil) {
+		return false
+	}
+	delete(r.m, addr)
+	return true
+}
+
+func (r *redialer) connected(addr string, inbound bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.m[addr] = &PeerState{Addr: addr, Connected: true, Inbound: inbound}
+}
+
+// failed records a failed or lost connection to addr and returns how long to
+// wait before retrying. It returns false if the peer is now considered dead.
+func (r *redialer) failed(addr string, err error, b Backoff, now time.Time) (time.Duration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.m[addr]
+	if !ok {
+		s = &PeerState{Addr: addr}
+		r.m[addr] = s
+	}
+	s.Connected = false
+	s.Failures++
+	if err != nil {
+		s.LastError = err.Error()
+	}
+	if s.Failures >= b.MaxFailures {
+		s.NextAttempt = time.Time{}
+		s.DeadUntil = now.Add(b.Cooldown)
+		return 0, false
+	}
+	d := b.delay(s.Failures)
+	s.NextAttempt = now.Add(d)
+	return d, true
+}
+
+// forget drops the state of a peer that is no longer being dialled,
+// unless it is remembered as dead.
+func (r *redialer) forget(addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, ok := r.m[addr]; ok && s.DeadUntil.IsZero() {
+		delete(r.m, addr)
+	}
+}
+
+func (r *redialer) states() []PeerState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l := make([]PeerState, 0, len(r.m))
+	for _, s := range r.m {
+		l = append(l, *s)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Addr < l[j].Addr })
+	return l
+}
@@ -0,0 +1,92 @@
+package whisper
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Initial: time.Second, Max: 10 * time.Second, Multiplier: 2, Jitter: 0.1}.withDefaults()
+	for _, tt := range []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{50, 10 * time.Second},
+	} {
+		d := b.delay(tt.failures)
+		if d < tt.want*9/10 || d > tt.want*11/10 {
+			t.Errorf("delay(%d) = %v, want %v ±10%%", tt.failures, d, tt.want)
+		}
+	}
+}
+
+func TestRedialerDead(t *testing.T) {
+	r := redialer{m: make(map[string]*PeerState)}
+	b := Backoff{MaxFailures: 2, Cooldown: time.Minute}.withDefaults()
+	now := time.Now()
+	if _, ok := r.failed("a", errors.New("refused"), b, now); !ok {
+		t.Fatal("peer dead after first failure")
+	}
+	if _, ok := r.failed("a", errors.New("refused"), b, now); ok {
+		t.Fatal("peer not dead after MaxFailures failures")
+	}
+	if r.alive("a", now.Add(30*time.Second)) {
+		t.Error("dead peer alive during cooldown")
+	}
+	if !r.alive("a", now.Add(2*time.Minute)) {
+		t.Error("dead peer not alive after cooldown")
+	}
+	if len(r.states()) != 0 {
+		t.Error("dead peer not forgotten after cooldown")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	// Reserve an address for b, but don't listen on it yet.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	a := newTestNode(t)
+	defer a.Close()
+	a.Backoff = Backoff{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond}
+	a.Start(context.Background(), addr)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s := a.PeerStates()
+		if len(s) == 1 && s[0].Failures > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("PeerStates() = %+v, want one failing peer", s)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip("could not listen on reserved address:", err)
+	}
+	b := NewNode(l)
+	b.Logger = a.Logger
+	defer b.Close()
+	ch, cancel := b.Subscribe()
+	defer cancel()
+	b.Start(context.Background())
+
+	sendUntil(t, a, ch, "hello")
+	if s := a.PeerStates(); len(s) != 1 || !s[0].Connected {
+		t.Errorf("PeerStates() = %+v, want one connected peer", s)
+	}
+}
@@ -0,0 +1,157 @@
+package whisper
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for the SeenCache created by NewNode.
+const (
+	DefaultSeenCapacity = 100000
+	DefaultSeenTTL      = 10 * time.Minute
+)
+
+// SeenCache is a bounded set of recently seen message IDs.
+//
+// It remembers at most (approximately) capacity IDs, evicting the least
+// recently seen ID when full, and forgets IDs that have not been seen for
+// longer than its TTL. IDs are spread over independently locked shards so
+// that concurrent lookups rarely contend.
+type SeenCache struct {
+	shards []seenShard
+	ttl    time.Duration
+	now    func() time.Time
+
+	hits        uint64
+	misses      uint64
+	evictions   uint64
+	expirations uint64
+}
+
+// SeenStats holds counters describing the activity of a SeenCache.
+type SeenStats struct {
+	Hits        uint64 // lookups of an ID already in the cache
+	Misses      uint64 // lookups of a new or expired ID
+	Evictions   uint64 // IDs dropped to make room for new ones
+	Expirations uint64 // IDs dropped because their TTL passed
+	Len         int    // IDs currently in the cache
+}
+
+type seenShard struct {
+	mu  sync.Mutex
+	cap int
+	ll  *list.List // of *seenEntry, most recently seen first
+	m   map[string]*list.Element
+}
+
+type seenEntry struct {
+	id   string
+	seen time.Time
+}
+
+// NewSeenCache returns a SeenCache holding up to capacity IDs, each for at
+// most ttl after it was last seen. A ttl of zero means IDs never expire.
+func NewSeenCache(capacity int, ttl time.Duration) *SeenCache {
+	if capacity < 1 {
+		capacity = 1
+	}
+	n := 16
+	for n > 1 && capacity/n < 64 {
+		n /= 2
+	}
+	c := &SeenCache{
+		shards: make([]seenShard, n),
+		ttl:    ttl,
+		now:    time.Now,
+	}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.cap = capacity / n
+		if i < capacity%n {
+			s.cap++
+		}
+		s.ll = list.New()
+		s.m = make(map[string]*list.Element)
+	}
+	return c
+}
+
+// Seen returns true if the specified id has been seen within the TTL.
+// In either case it marks the id as seen now.
+func (c *SeenCache) Seen(id string) bool {
+	s := c.shard(id)
+	now := c.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.m[id]; ok {
+		ent := e.Value.(*seenEntry)
+		if !c.expired(ent, now) {
+			ent.seen = now
+			s.ll.MoveToFront(e)
+			atomic.AddUint64(&c.hits, 1)
+			return true
+		}
+		s.ll.Remove(e)
+		delete(s.m, id)
+		atomic.AddUint64(&c.expirations, 1)
+	}
+	atomic.AddUint64(&c.misses, 1)
+
+	// Entries are ordered by last use, so expired ones are at the back.
+	for e := s.ll.Back(); e != nil; e = s.ll.Back() {
+		ent := e.Value.(*seenEntry)
+		if c.expired(ent, now) {
+			atomic.AddUint64(&c.expirations, 1)
+		} else if s.ll.Len() >= s.cap {
+			atomic.AddUint64(&c.evictions, 1)
+		} else {
+			break
+		}
+		s.ll.Remove(e)
+		delete(s.m, ent.id)
+	}
+	s.m[id] = s.ll.PushFront(&seenEntry{id: id, seen: now})
+	return false
+}
+
+// Has reports whether id has been seen within the TTL, without marking it
+// as seen or counting the lookup.
+func (c *SeenCache) Has(id string) bool {
+	s := c.shard(id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.m[id]
+	return ok && !c.expired(e.Value.(*seenEntry), c.now())
+}
+
+// Stats returns a snapshot of the cache counters.
+func (c *SeenCache) Stats() SeenStats {
+	st := SeenStats{
+		Hits:        atomic.LoadUint64(&c.hits),
+		Misses:      atomic.LoadUint64(&c.misses),
+		Evictions:   atomic.LoadUint64(&c.evictions),
+		Expirations: atomic.LoadUint64(&c.expirations),
+	}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		st.Len += s.ll.Len()
+		s.mu.Unlock()
+	}
+	return st
+}
+
+func (c *SeenCache) shard(id string) *seenShard {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return &c.shards[h.Sum32()%uint32(len(c.shards))]
+}
+
+func (c *SeenCache) expired(e *seenEntry, now time.Time) bool {
+	return c.ttl > 0 && now.Sub(e.seen) > c.ttl
+}
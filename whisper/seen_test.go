@@ -0,0 +1,95 @@
+package whisper
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSeenCacheEviction(t *testing.T) {
+	c := NewSeenCache(3, 0)
+	for _, id := range []string{"a", "b", "c"} {
+		if c.Seen(id) {
+			t.Fatalf("Seen(%q) = true on first sight", id)
+		}
+	}
+	c.Seen("a") // make "b" the least recently seen
+	c.Seen("d") // evicts "b"
+	if c.Seen("a") != true || c.Seen("d") != true {
+		t.Error(`"a" or "d" evicted, want "b"`)
+	}
+	if c.Seen("b") {
+		t.Error(`Seen("b") = true, want it evicted`)
+	}
+	st := c.Stats()
+	if st.Len != 3 {
+		t.Errorf("Len = %d, want 3", st.Len)
+	}
+	if st.Evictions != 2 {
+		t.Errorf("Evictions = %d, want 2", st.Evictions)
+	}
+	if st.Hits != 3 {
+		t.Errorf("Hits = %d, want 3", st.Hits)
+	}
+}
+
+func TestSeenCacheTTL(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := NewSeenCache(10, time.Minute)
+	c.now = func() time.Time { return now }
+
+	c.Seen("a")
+	now = now.Add(30 * time.Second)
+	if !c.Seen("a") {
+		t.Error(`Seen("a") = false within TTL`)
+	}
+	c.Seen("b")
+	now = now.Add(61 * time.Second)
+	if c.Seen("a") {
+		t.Error(`Seen("a") = true after TTL`)
+	}
+	st := c.Stats()
+	if st.Expirations != 2 {
+		t.Errorf("Expirations = %d, want 2", st.Expirations)
+	}
+	if st.Len != 1 {
+		t.Errorf("Len = %d, want 1", st.Len)
+	}
+}
+
+func TestSeenCacheConcurrent(t *testing.T) {
+	const n = 10000
+	c := NewSeenCache(2*n, 0) // shards fill unevenly
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				c.Seen(fmt.Sprint(i))
+			}
+		}()
+	}
+	wg.Wait()
+	st := c.Stats()
+	if st.Misses != n || st.Hits != 3*n {
+		t.Errorf("Misses, Hits = %d, %d; want %d, %d", st.Misses, st.Hits, n, 3*n)
+	}
+}
+
+func TestSeenCacheHas(t *testing.T) {
+	c := NewSeenCache(10, 0)
+	if c.Has("a") {
+		t.Error(`Has("a") = true before it was seen`)
+	}
+	if c.Has("a") || c.Seen("a") {
+		t.Error("Has marked the ID as seen")
+	}
+	if !c.Has("a") {
+		t.Error(`Has("a") = false after it was seen`)
+	}
+	if st := c.Stats(); st.Hits != 0 || st.Misses != 1 {
+		t.Errorf("Stats() = %+v, want only the Seen lookup counted", st)
+	}
+}
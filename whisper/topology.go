@@ -0,0 +1,179 @@
+package whisper
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Each node periodically floods a Report of its connections to the mesh.
+// Every node keeps the latest report from each origin, so that any of them
+// can describe the whole mesh, and relays only reports newer than the one
+// it has, which ends the flood.
+
+// DefaultReportInterval is the default interval between topology reports.
+const DefaultReportInterval = 10 * time.Second
+
+// A node whose last report is older than reportLive report intervals is
+// considered down, and its report is forgotten after reportKeep intervals.
+const (
+	reportLive = 3
+	reportKeep = 10
+)
+
+// maxReportSkew is how far ahead of the local clock a report may be dated.
+// A report dated later is refused, so that a bad clock or a forged report
+// cannot pin a node's entry and shut out its genuine reports.
+const maxReportSkew = time.Minute
+
+// Report is the payload of a TypeReport envelope: a node's connections
+// when it sent the report.
+type Report struct {
+	Addr  string
+	Time  time.Time
+	Peers []Edge
+}
+
+// Edge is a connection from the reporting node to a peer.
+type Edge struct {
+	Addr     string
+	Inbound  bool   // the peer dialled the reporting node
+	Sent     uint64 // messages sent to the peer
+	Received uint64 // messages received from the peer
+}
+
+// NodeReport is the latest report from a node, as seen by another.
+type NodeReport struct {
+	Report
+	Live bool // the report arrived recently
+}
+
+// topology holds the latest report from each node.
+type topology struct {
+	mu sync.Mutex
+	m  map[string]*NodeReport
+	t  map[string]time.Time // when each report arrived
+}
+
+// set records r, received at now, and reports whether it is newer than
+// the report held from the same node. Reports dated more than maxReportSkew
+// after now are refused.
+func (t *topology) set(r Report, now time.Time) bool {
+	if r.Time.After(now.Add(maxReportSkew)) {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if old, ok := t.m[r.Addr]; ok && !r.Time.After(old.Time) {
+		return false
+	}
+	t.m[r.Addr] = &NodeReport{Report: r}
+	t.t[r.Addr] = now
+	return true
+}
+
+// list returns the reports, in address order, forgetting those older than
+// keep and marking those younger than live.
+func (t *topology) list(now time.Time, live, keep time.Duration) []NodeReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l := make([]NodeReport, 0, len(t.m))
+	for addr, r := range t.m {
+		age := now.Sub(t.t[addr])
+		if age > keep {
+			delete(t.m, addr)
+			delete(t.t, addr)
+			continue
+		}
+		nr := *r
+		nr.Live = age <= live
+		l = append(l, nr)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Addr < l[j].Addr })
+	return l
+}
+
+// Topology returns the latest report from each node in the mesh,
+// including a current one from n itself, in address order.
+func (n *Node) Topology() []NodeReport {
+	d := n.reportInterval()
+	if d < 0 {
+		d = DefaultReportInterval
+	}
+	now := time.Now()
+	n.topo.set(n.newReport(), now)
+	return n.topo.list(now, reportLive*d, reportKeep*d)
+}
+
+func (n *Node) reportInterval() time.Duration {
+	if n.ReportInterval != 0 {
+		return n.ReportInterval
+	}
+	return DefaultReportInterval
+}
+
+// newReport returns a report of the node's current connections.
+func (n *Node) newReport() Report {
+	r := Report{Addr: n.self, Time: time.Now()}
+	for _, s := range n.redial.states() {
+		if !s.Connected {
+			continue
+		}
+		ps := n.stats.peer(s.Addr)
+		r.Peers = append(r.Peers, Edge{
+			Addr:     s.Addr,
+			Inbound:  s.Inbound,
+			Sent:     atomic.LoadUint64(&ps.sent),
+			Received: atomic.LoadUint64(&ps.received),
+		})
+	}
+	return r
+}
+
+// report periodically floods the node's report to the mesh.
+func (n *Node) report() {
+	d := n.reportInterval()
+	if d < 0 {
+		return
+	}
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-n.ctx.Done():
+			return
+		}
+		r := n.newReport()
+		n.topo.set(r, time.Now())
+		n.floodReport(r, "")
+	}
+}
+
+// relayReport records a report received from the peer at address from and
+// passes it on to the node's other peers.
+func (n *Node) relayReport(r Report, from string) {
+	if r.Addr == n.self || !n.topo.set(r, time.Now()) {
+		return
+	}
+	n.floodReport(r, from)
+}
+
+// floodReport queues r for every peer except the one at address except.
+// Reports are dropped for peers that are not keeping up.
+func (n *Node) floodReport(r Report, except string) {
+	env, err := NewEnvelope(TypeReport, r)
+	if err != nil {
+		return
+	}
+	for _, q := range n.peers.List() {
+		if q.Addr == except {
+			continue
+		}
+		select {
+		case q.ctl <- env:
+		default:
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package whisper
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTopology(t *testing.T) {
+	// a -> b <- c
+	a, b, c := newTestNode(t), newTestNode(t), newTestNode(t)
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+	for _, n := range []*Node{a, b, c} {
+		n.ReportInterval = 20 * time.Millisecond
+	}
+	a.MaxPeers, c.MaxPeers = 1, 1
+	b.Start(context.Background())
+	a.Start(context.Background(), b.Addr())
+	c.Start(context.Background(), b.Addr())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var edge *Edge
+		for _, r := range a.Topology() {
+			if r.Addr == c.Addr() && r.Live && len(r.Peers) == 1 {
+				edge = &r.Peers[0]
+			}
+		}
+		if edge != nil {
+			if edge.Addr != b.Addr() || edge.Inbound {
+				t.Errorf("c reported %+v, want outbound edge to b", *edge)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("a did not learn c's connections: %+v", a.Topology())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTopologyStale(t *testing.T) {
+	tp := topology{m: make(map[string]*NodeReport), t: make(map[string]time.Time)}
+	now := time.Unix(0, 0)
+	if !tp.set(Report{Addr: "x", Time: now}, now) {
+		t.Fatal("first report not recorded")
+	}
+	if tp.set(Report{Addr: "x", Time: now}, now) {
+		t.Error("repeated report recorded as newer")
+	}
+	if tp.set(Report{Addr: "x", Time: now.Add(24 * time.Hour)}, now) {
+		t.Error("report from the future recorded")
+	}
+	if !tp.set(Report{Addr: "x", Time: now.Add(time.Second)}, now) {
+		t.Error("report slightly ahead of the clock not recorded")
+	}
+	if l := tp.list(now.Add(2*time.Second), time.Second, time.Minute); len(l) != 1 || l[0].Live {
+		t.Errorf("list = %+v, want one stale report", l)
+	}
+	if l := tp.list(now.Add(2*time.Minute), time.Second, time.Minute); len(l) != 0 {
+		t.Errorf("list = %+v, want old report forgotten", l)
+	}
+}
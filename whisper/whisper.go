@@ -0,0 +1,424 @@
+// Package whisper implements a node of the whispernet, the peer-to-peer chat
+// network built in the "Whispering Gophers" code lab.
+//
+// A Node accepts connections from peers, connects to every peer it hears
+// about, and floods each message it has not seen before to all of its peers.
+package whisper
+
+import (
+	"context"
+	"crypto/ed25519"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.google.com/p/whispering-gophers/util"
+)
+
+// Message is the unit of communication between nodes.
+type Message struct {
+	ID   string
+	Addr string
+	Body string
+
+	// Key and Sig are the public key of the node that originated the
+	// message and its signature of the message, if it was signed.
+	Key string `json:",omitempty"`
+	Sig string `json:",omitempty"`
+
+	// Channel is the name of the channel the message was posted to,
+	// or empty for messages to everyone.
+	Channel string `json:",omitempty"`
+
+	// To, if set, is the public key of the only node that can read the
+	// message. See SendDirect.
+	To string `json:",omitempty"`
+
+	// Clock is the sender's Lamport clock when it sent the message, and
+	// ReplyTo is the ID of the message it answers, if any. They let
+	// receivers display a conversation in causal order; see Ordered.
+	Clock   uint64 `json:",omitempty"`
+	ReplyTo string `json:",omitempty"`
+
+	// TTL is the number of hops the message may still travel,
+	// or zero if it is unlimited. It is carried in the Envelope.
+	TTL int `json:"-"`
+}
+
+// Node is a whispernet peer.
+//
+// The exported fields may be set after NewNode and before Start,
+// and must not be changed afterwards.
+type Node struct {
+	// Dial connects to the peer at the given address, giving up when ctx,
+	// which is done when the node shuts down, is done.
+	// If nil, a net.Dialer is used to connect over TCP.
+	Dial func(ctx context.Context, addr string) (net.Conn, error)
+
+	// DisableDedup turns off de-duplication of messages by ID,
+	// so that every incoming message is delivered and rebroadcast.
+	DisableDedup bool
+
+	// QueueSize is the number of outgoing messages buffered for each peer.
+	// If zero, DefaultQueueSize is used.
+	QueueSize int
+
+	// Overflow selects what happens to a message sent to a peer whose
+	// queue is full. Under the Block policy, broadcasting waits at most
+	// BlockTimeout (DefaultBlockTimeout if zero) for each peer.
+	Overflow     Overflow
+	BlockTimeout time.Duration
+
+	// Backoff controls reconnection to peers whose connection failed.
+	Backoff Backoff
+
+	// TTL is the hop limit given to messages sent with Send.
+	// Zero means unlimited.
+	TTL int
+
+	// MaxTTL, if positive, caps the hop limit of every message the node
+	// relays, including those that arrive without one.
+	MaxTTL int
+
+	// MinPeers is the number of connections the node tries to maintain by
+	// dialling addresses learned through peer exchange. If zero,
+	// DefaultMinPeers is used; if negative, no such dialling is done.
+	// MaxPeers, if positive, stops the node dialling newly learned
+	// addresses once it has that many connections.
+	MinPeers int
+	MaxPeers int
+
+	// PEXInterval is how often the node sends each peer a sample of the
+	// addresses it knows, and checks that it has MinPeers connections.
+	// If zero, DefaultPEXInterval is used.
+	PEXInterval time.Duration
+
+	// AntiEntropyInterval is how often the node sends each peer a digest
+	// of the messages it has recently sent or relayed, so that the peer
+	// can ask for any it missed. If zero, DefaultAntiEntropyInterval is
+	// used; if negative, no digests are sent.
+	AntiEntropyInterval time.Duration
+
+	// ReportInterval is how often the node floods a report of its
+	// connections to the mesh; see Topology. If zero,
+	// DefaultReportInterval is used; if negative, no reports are sent.
+	ReportInterval time.Duration
+
+	// Identity, if set, is used to sign the messages the node sends.
+	Identity *Identity
+
+	// RequireSignatures makes the node drop unsigned messages.
+	// If TrustedKeys is non-empty, the node drops messages that are not
+	// signed by one of those keys. Messages with an invalid signature are
+	// always dropped.
+	RequireSignatures bool
+	TrustedKeys       []ed25519.PublicKey
+
+	// SeenIDs remembers the IDs of messages already handled.
+	// NewNode sets it to a cache with DefaultSeenCapacity and DefaultSeenTTL.
+	SeenIDs *SeenCache
+
+	// History, if set, records every message the node sends or receives
+	// and answers peers' requests for past messages.
+	History *History
+
+	// SyncHistory, if set, is sent to each peer the node connects to,
+	// asking for the messages it missed. Replayed messages are delivered
+	// to subscribers but not relayed.
+	SyncHistory *HistoryRequest
+
+	// Logger is used to log connection events and errors. Messages
+	// received are logged at the Debug level.
+	// If nil, slog.Default() is used.
+	Logger *slog.Logger
+
+	// Trace logs everything the node writes to and reads from its peer
+	// connections.
+	Trace bool
+
+	l      net.Listener
+	self   string
+	peers  *Peers
+	redial redialer
+	known  known
+	keys   directory
+	recent recent
+	stats  stats
+	topo   topology
+	clock  uint64 // Lamport clock; accessed atomically
+
+	ctx    context.Context // cancelled when the node shuts down
+	cancel context.CancelFunc
+	wg     sync.WaitGroup // accept, serve and dial goroutines
+	once   sync.Once
+	err    error // result of closing l
+
+	mu       sync.Mutex
+	closed   bool
+	subs     map[chan Message]bool
+	channels map[string]bool // joined channels
+}
+
+// NewNode returns a Node that accepts peer connections on l.
+// The address of l is used as the node's own address.
+func NewNode(l net.Listener) *Node {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Node{
+		l:        l,
+		self:     l.Addr().String(),
+		peers:    NewPeers(),
+		redial:   redialer{m: make(map[string]*PeerState)},
+		known:    known{m: make(map[string]bool)},
+		keys:     directory{m: make(map[string]string)},
+		recent:   recent{m: make(map[string]recentEntry)},
+		stats:    stats{peers: make(map[string]*peerStats)},
+		topo:     topology{m: make(map[string]*NodeReport), t: make(map[string]time.Time)},
+		SeenIDs:  NewSeenCache(DefaultSeenCapacity, DefaultSeenTTL),
+		ctx:      ctx,
+		cancel:   cancel,
+		subs:     make(map[chan Message]bool),
+		channels: make(map[string]bool),
+	}
+}
+
+// Addr returns the address at which the node accepts connections.
+func (n *Node) Addr() string {
+	return n.self
+}
+
+// Start starts accepting connections from peers and connects to the given
+// peer addresses. It does not block.
+// The node shuts down, as if by Close, when ctx is cancelled.
+func (n *Node) Start(ctx context.Context, peers ...string) {
+	n.goFunc(n.accept)
+	n.goFunc(n.maintain)
+	n.goFunc(n.report)
+	for _, addr := range peers {
+		if addr == "" {
+			continue
+		}
+		n.known.add(addr)
+		addr := addr
+		n.goFunc(func() { n.dial(addr, 0) })
+	}
+	context.AfterFunc(ctx, func() { n.Close() })
+}
+
+// PeerStates reports the connection state of each peer the node is
+// connected to, reconnecting to, or remembers as dead.
+func (n *Node) PeerStates() []PeerState {
+	l := n.redial.states()
+	for i := range l {
+		if q := n.peers.Get(l[i].Addr); q != nil {
+			l[i].Queued = q.Len()
+			l[i].Dropped = q.Dropped()
+		}
+	}
+	return l
+}
+
+// Done returns a channel that is closed when the node begins shutting down.
+func (n *Node) Done() <-chan struct{} {
+	return n.ctx.Done()
+}
+
+// Send broadcasts a new message with the given body to all connected peers
+// and returns it.
+func (n *Node) Send(body string) Message {
+	return n.SendTTL(body, n.TTL)
+}
+
+// SendTTL is like Send but limits the message to ttl hops.
+// A ttl of zero means unlimited.
+func (n *Node) SendTTL(body string, ttl int) Message {
+	return n.send(n.newMessage(body, ttl))
+}
+
+// Reply broadcasts a new message with the given body in answer to m,
+// on the same channel as m. A direct message is answered privately.
+func (n *Node) Reply(m Message, body string) (Message, error) {
+	if m.To != "" {
+		return n.sendDirect(m.Addr, body, m.ID)
+	}
+	r := n.newMessage(body, n.TTL)
+	r.Channel = m.Channel
+	r.ReplyTo = m.ID
+	return n.send(r), nil
+}
+
+// send stamps m with the node's clock, signs it if the node has an
+// identity, and broadcasts it.
+func (n *Node) send(m Message) Message {
+	m.Clock = atomic.AddUint64(&n.clock, 1)
+	if n.Identity != nil {
+		n.Identity.Sign(&m)
+	}
+	n.Seen(m.ID)
+	n.record(m)
+	n.recent.add(m, time.Now())
+	n.broadcast(m, "")
+	return m
+}
+
+func (n *Node) newMessage(body string, ttl int) Message {
+	return Message{
+		ID:   util.RandomID(),
+		Addr: n.self,
+		Body: body,
+		TTL:  ttl,
+	}
+}
+
+// Subscribe returns a channel on which messages received from peers are
+// delivered, and a function that cancels the subscription.
+// Direct messages are delivered, decrypted, only to their recipient, and
+// channel messages only if the node has joined the channel.
+// Messages are dropped if the subscriber does not keep up.
+// The channel is closed when the subscription is cancelled or the node is
+// closed.
+func (n *Node) Subscribe() (<-chan Message, func()) {
+	ch := make(chan Message, 16)
+	n.mu.Lock()
+	if n.closed {
+		close(ch)
+	} else {
+		n.subs[ch] = true
+	}
+	n.mu.Unlock()
+	cancel := func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if n.subs[ch] {
+			delete(n.subs, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+// Close shuts the node down. It stops accepting connections, lets each
+// peer connection write out the messages already queued for it, closes all
+// connections and cancels all subscriptions.
+// It waits for the node's goroutines to exit before returning.
+func (n *Node) Close() error {
+	n.once.Do(func() {
+		n.cancel()
+		n.err = n.l.Close()
+	})
+	n.wg.Wait()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.closed {
+		n.closed = true
+		for ch := range n.subs {
+			close(ch)
+		}
+		n.subs = nil
+	}
+	return n.err
+}
+
+// Seen returns true if the specified id has been seen recently, as
+// remembered by n.SeenIDs. If not, it returns false and marks the given id
+// as "seen".
+func (n *Node) Seen(id string) bool {
+	if n.DisableDedup || id == "" {
+		return false
+	}
+	return n.SeenIDs.Seen(id)
+}
+
+func (n *Node) accept() {
+	for {
+		c, err := n.l.Accept()
+		if err != nil {
+			if n.ctx.Err() == nil {
+				n.logger().Error("accept error", "err", err)
+			}
+			return
+		}
+		n.goFunc(func() { n.serve(c) })
+	}
+}
+
+// broadcast queues m for every peer except the one at address except.
+func (n *Node) broadcast(m Message, except string) {
+	timeout := n.blockTimeout()
+	for _, q := range n.peers.List() {
+		if q.Addr != except {
+			q.Put(m, n.Overflow, timeout)
+		}
+	}
+}
+
+func (n *Node) blockTimeout() time.Duration {
+	if n.BlockTimeout > 0 {
+		return n.BlockTimeout
+	}
+	return DefaultBlockTimeout
+}
+
+// hop returns m as it should be relayed to the next hop, or false if it has
+// reached its hop limit.
+func (n *Node) hop(m Message) (Message, bool) {
+	if n.MaxTTL > 0 && (m.TTL <= 0 || m.TTL > n.MaxTTL) {
+		m.TTL = n.MaxTTL
+	}
+	switch {
+	case m.TTL == 1:
+		return m, false
+	case m.TTL > 1:
+		m.TTL--
+	}
+	return m, true
+}
+
+// verify reports why m should be dropped under the node's signature
+// policy, or nil if it is acceptable.
+func (n *Node) verify(m Message) error {
+	err := Verify(m, n.TrustedKeys)
+	if err == ErrUnsigned && !n.RequireSignatures && len(n.TrustedKeys) == 0 {
+		return nil
+	}
+	return err
+}
+
+// observe advances the node's clock past that of a received message.
+func (n *Node) observe(m Message) {
+	for {
+		c := atomic.LoadUint64(&n.clock)
+		if m.Clock <= c || atomic.CompareAndSwapUint64(&n.clock, c, m.Clock) {
+			return
+		}
+	}
+}
+
+func (n *Node) publish(m Message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for ch := range n.subs {
+		select {
+		case ch <- m:
+		default:
+		}
+	}
+}
+
+// goFunc runs f in a new goroutine that Close waits for.
+func (n *Node) goFunc(f func()) {
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		f()
+	}()
+}
+
+func (n *Node) logger() *slog.Logger {
+	if n.Logger != nil {
+		return n.Logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,245 @@
+package whisper
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestNode(t *testing.T) *Node {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := NewNode(l)
+	n.Logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	return n
+}
+
+// sendUntil sends body from n until it arrives on ch.
+// Messages may be dropped while the connection is being established.
+func sendUntil(t *testing.T, n *Node, ch <-chan Message, body string) Message {
+	timeout := time.After(5 * time.Second)
+	for {
+		n.Send(body)
+		select {
+		case m := <-ch:
+			if m.Body != body {
+				continue
+			}
+			return m
+		case <-time.After(50 * time.Millisecond):
+		case <-timeout:
+			t.Fatalf("message %q not delivered", body)
+		}
+	}
+}
+
+func TestNode(t *testing.T) {
+	a, b := newTestNode(t), newTestNode(t)
+	defer a.Close()
+	defer b.Close()
+
+	a.Identity, _ = NewIdentity()
+	b.RequireSignatures = true
+	chB, cancel := b.Subscribe()
+	defer cancel()
+	b.Start(context.Background())
+	a.Start(context.Background(), b.Addr())
+
+	m := sendUntil(t, a, chB, "hello")
+	if m.Addr != a.Addr() {
+		t.Errorf("message Addr = %q, want %q", m.Addr, a.Addr())
+	}
+	if m.Key != a.Identity.String() {
+		t.Errorf("message Key = %q, want %q", m.Key, a.Identity)
+	}
+
+	// b learned about a from the message and should be able to reply.
+	chA, cancel := a.Subscribe()
+	defer cancel()
+	sendUntil(t, b, chA, "ahoy")
+}
+
+func TestSeen(t *testing.T) {
+	n := newTestNode(t)
+	defer n.Close()
+	if n.Seen("x") {
+		t.Error(`first Seen("x") = true, want false`)
+	}
+	if !n.Seen("x") {
+		t.Error(`second Seen("x") = false, want true`)
+	}
+	if n.Seen("") {
+		t.Error(`Seen("") = true, want false`)
+	}
+}
+
+func TestClose(t *testing.T) {
+	n := newTestNode(t)
+	ch, _ := n.Subscribe()
+	n.Start(context.Background())
+	if err := n.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-ch; ok {
+		t.Error("subscription channel not closed by Close")
+	}
+	if _, err := net.Dial("tcp", n.Addr()); err == nil {
+		t.Error("node still accepting connections after Close")
+	}
+}
+
+func TestStartContext(t *testing.T) {
+	a, b := newTestNode(t), newTestNode(t)
+	defer b.Close()
+	chB, cancel := b.Subscribe()
+	defer cancel()
+	b.Start(context.Background())
+
+	ctx, stop := context.WithCancel(context.Background())
+	a.Start(ctx, b.Addr())
+	sendUntil(t, a, chB, "hello")
+
+	stop()
+	select {
+	case <-a.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("node not shut down after context cancellation")
+	}
+	// Close waits for the shutdown started by the context to complete.
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.Dial("tcp", a.Addr()); err == nil {
+		t.Error("node still accepting connections after shutdown")
+	}
+}
+
+func TestCloseWhileDialling(t *testing.T) {
+	n := newTestNode(t)
+	dialling := make(chan bool, 1)
+	// A blackholed address: the dial returns only when given up.
+	n.Dial = func(ctx context.Context, addr string) (net.Conn, error) {
+		dialling <- true
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	n.Start(context.Background(), "192.0.2.1:1")
+	<-dialling
+	done := make(chan error, 1)
+	go func() { done <- n.Close() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked by a pending dial")
+	}
+}
+
+func TestHop(t *testing.T) {
+	n := newTestNode(t)
+	defer n.Close()
+	for _, tt := range []struct {
+		maxTTL, ttl int
+		want        int
+		relay       bool
+	}{
+		{0, 0, 0, true},
+		{0, 3, 2, true},
+		{0, 1, 1, false},
+		{2, 0, 1, true},
+		{2, 5, 1, true},
+		{2, 1, 1, false},
+	} {
+		n.MaxTTL = tt.maxTTL
+		m, ok := n.hop(Message{TTL: tt.ttl})
+		if m.TTL != tt.want || ok != tt.relay {
+			t.Errorf("MaxTTL=%d: hop(TTL=%d) = %d, %v; want %d, %v",
+				tt.maxTTL, tt.ttl, m.TTL, ok, tt.want, tt.relay)
+		}
+	}
+}
+
+func TestTTL(t *testing.T) {
+	// a -> b -> c, with a sending messages limited to one hop.
+	a, b, c := newTestNode(t), newTestNode(t), newTestNode(t)
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+	chB, cancel := b.Subscribe()
+	defer cancel()
+	chC, cancel := c.Subscribe()
+	defer cancel()
+	a.TTL = 1
+	// Keep peer exchange from connecting a and c directly.
+	a.MaxPeers, c.MaxPeers = 1, 1
+	c.Start(context.Background())
+	b.Start(context.Background(), c.Addr())
+	a.Start(context.Background(), b.Addr())
+
+	// Make sure b -> c works before testing the hop limit.
+	sendUntil(t, b, chC, "warm up")
+
+	m := sendUntil(t, a, chB, "one hop")
+	if m.TTL != 1 {
+		t.Fatalf("b received TTL %d, want 1", m.TTL)
+	}
+	timeout := time.After(100 * time.Millisecond)
+	for {
+		select {
+		case m := <-chC:
+			if m.Body == "one hop" {
+				t.Fatal("message relayed past its hop limit")
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+func TestDuplex(t *testing.T) {
+	a, b := newTestNode(t), newTestNode(t)
+	defer a.Close()
+	defer b.Close()
+	// b can't dial out, as if a were behind a NAT,
+	// so it must reply on the connection a made.
+	b.Dial = func(_ context.Context, addr string) (net.Conn, error) {
+		t.Errorf("b dialled %v", addr)
+		return nil, errors.New("unreachable")
+	}
+	chA, cancel := a.Subscribe()
+	defer cancel()
+	b.Start(context.Background())
+	a.Start(context.Background(), b.Addr())
+
+	sendUntil(t, b, chA, "hello")
+	if s := b.PeerStates(); len(s) != 1 || s[0].Addr != a.Addr() || !s[0].Connected {
+		t.Errorf("b.PeerStates() = %+v, want a connected", s)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	a, b := newTestNode(t), newTestNode(t)
+	var buf bytes.Buffer
+	a.Logger = slog.New(slog.NewTextHandler(&buf, nil))
+	a.Trace = true
+	chB, cancel := b.Subscribe()
+	defer cancel()
+	b.Start(context.Background())
+	a.Start(context.Background(), b.Addr())
+	sendUntil(t, a, chB, "traced")
+	a.Close()
+	b.Close()
+	if s := buf.String(); !strings.Contains(s, "msg=wire") || !strings.Contains(s, `Body\":\"traced`) {
+		t.Errorf("trace log lacks the message sent:\n%s", s)
+	}
+}